@@ -0,0 +1,172 @@
+package tiptop
+
+import "sync/atomic"
+
+const (
+	// the window is the part of shard which the new entries are pushed to before they are admitted.
+	admissionWindowRatio = 0.01
+	// the number of bytes of shard per counter of the sketch.
+	sketchBytesPerCounter = 128
+	sketchMinWidth        = 16
+	sketchDepth           = 4
+	sketchCountersPerWord = 4
+	// the counters are halved once the additions reach the sample size, which is the times of width.
+	sketchSampleRatio = 10
+	sketchMaxCount    = 15
+)
+
+var sketchSeeds = [sketchDepth]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325}
+
+// frequencySketch is a count-min sketch estimating how often the hashes are accessed recently.
+// All counters are halved periodically, so the frequency of the hashes not accessed any more decays.
+// The 8-bit counters are packed by four into the words updated by atomic operations instead of a lock, so the reads
+// of shard don't wait for each other. The increment lost to a concurrent update is ignored, as the sketch is an estimate.
+type frequencySketch struct {
+	table     [sketchDepth][]uint32
+	mask      uint64
+	additions int64
+	sample    int64
+}
+
+func newFrequencySketch(maxShardSize int) *frequencySketch {
+	width := sketchMinWidth
+	for width < maxShardSize/sketchBytesPerCounter {
+		width <<= 1
+	}
+	f := &frequencySketch{
+		mask:   uint64(width - 1),
+		sample: int64(width * sketchSampleRatio),
+	}
+	for i := range f.table {
+		f.table[i] = make([]uint32, width/sketchCountersPerWord)
+	}
+	return f
+}
+
+// counter returns the word holding the counter of the hash in the row i, and the shift of the counter in it.
+func (f *frequencySketch) counter(hash uint64, i int) (*uint32, uint) {
+	h := (hash ^ sketchSeeds[i]) * 0x9e3779b97f4a7c15
+	index := (h >> 32) & f.mask
+	return &f.table[i][index/sketchCountersPerWord], uint(index%sketchCountersPerWord) * 8
+}
+
+// increment records an access of the hash.
+func (f *frequencySketch) increment(hash uint64) {
+	added := false
+	for i := range f.table {
+		word, shift := f.counter(hash, i)
+		w := atomic.LoadUint32(word)
+		if w>>shift&0xff < sketchMaxCount && atomic.CompareAndSwapUint32(word, w, w+1<<shift) {
+			added = true
+		}
+	}
+	// only the increment reaching the sample ages the counters.
+	if added && atomic.AddInt64(&f.additions, 1) == f.sample {
+		f.age()
+	}
+}
+
+// estimate returns the frequency of the hash, which is the minimum of its counters.
+func (f *frequencySketch) estimate(hash uint64) uint8 {
+	min := uint8(sketchMaxCount)
+	for i := range f.table {
+		word, shift := f.counter(hash, i)
+		if c := uint8(atomic.LoadUint32(word) >> shift); c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// age halves all counters and the additions.
+func (f *frequencySketch) age() {
+	for i := range f.table {
+		for j := range f.table[i] {
+			for {
+				w := atomic.LoadUint32(&f.table[i][j])
+				if atomic.CompareAndSwapUint32(&f.table[i][j], w, w>>1&0x7f7f7f7f) {
+					break
+				}
+			}
+		}
+	}
+	atomic.AddInt64(&f.additions, -f.sample/2)
+}
+
+func (f *frequencySketch) reset() {
+	for i := range f.table {
+		for j := range f.table[i] {
+			atomic.StoreUint32(&f.table[i][j], 0)
+		}
+	}
+	atomic.StoreInt64(&f.additions, 0)
+}
+
+// admitOldest pops the oldest entry of the window and tries to admit it to the queue.
+// It must be called with the lock held.
+func (s *shard) admitOldest() {
+	candidate, err := s.window.Pop()
+	if err != nil {
+		return
+	}
+	if hash := readHashFromEntry(candidate); hash != 0 {
+		s.admit(hash, candidate)
+	}
+}
+
+// admit pushes the entry of the hash to the queue if there is room, or it is accessed more often than
+// the oldest entry which will be removed for it. Otherwise the entry is rejected and removed from in-memory.
+// It must be called with the lock held.
+func (s *shard) admit(hash uint64, w []byte) {
+	if index, err := s.entries.Push(w); err == nil {
+		s.marker[hash] = index
+		return
+	}
+	if s.sketch.estimate(hash) > s.sketch.estimate(s.victim()) {
+		if index, err := s.pushEntry(w); err == nil {
+			s.marker[hash] = index
+			return
+		}
+	}
+	s.statsRejection()
+	s.evict(hash, w)
+}
+
+// victim returns the hash of the oldest live entry of the queue which is the next to be removed, or the one
+// of the window if the queue is empty. The dead entries before it are popped. It must be called with the lock held.
+func (s *shard) victim() uint64 {
+	if hash := oldestLive(&s.entries); hash != 0 {
+		return hash
+	}
+	return oldestLive(&s.window)
+}
+
+// removeVictim removes the entry returned by victim, which is of the window if the queue is empty.
+// It must be called with the lock held.
+func (s *shard) removeVictim() error {
+	if s.entries.Len() > 0 {
+		return s.removeOldest()
+	}
+	oldest, err := s.window.Pop()
+	if err != nil {
+		return err
+	}
+	if hash := readHashFromEntry(oldest); hash != 0 {
+		s.evict(hash, oldest)
+	}
+	return nil
+}
+
+// oldestLive returns the hash of the oldest live entry of the queue, the dead entries before it are popped.
+func oldestLive(queue *ByteQueue) uint64 {
+	for {
+		oldest, err := queue.Peek()
+		if err != nil {
+			return 0
+		}
+		if hash := readHashFromEntry(oldest); hash != 0 {
+			return hash
+		}
+		_, _ = queue.Pop()
+	}
+}
@@ -0,0 +1,179 @@
+package tiptop
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestFrequencySketch(t *testing.T) {
+	f := newFrequencySketch(64 * KB)
+	for i := 0; i < 10; i++ {
+		f.increment(1)
+	}
+	f.increment(2)
+	if e := f.estimate(1); e != 10 {
+		t.Fatalf("expected 10, got %d", e)
+	}
+	if e := f.estimate(2); e != 1 {
+		t.Fatalf("expected 1, got %d", e)
+	}
+	for i := 0; i < 100; i++ {
+		f.increment(1)
+	}
+	if e := f.estimate(1); e != sketchMaxCount {
+		t.Fatalf("expected the counter is saturated, got %d", e)
+	}
+
+	// the counters are halved once the additions reach the sample
+	for i := uint64(3); f.estimate(1) == sketchMaxCount; i++ {
+		f.increment(i)
+	}
+	if e := f.estimate(1); e != sketchMaxCount/2 {
+		t.Fatalf("expected the counter is halved, got %d", e)
+	}
+
+	f.reset()
+	if e := f.estimate(1); e != 0 {
+		t.Fatalf("expected 0, got %d", e)
+	}
+}
+
+func TestFrequencySketch_Concurrent(t *testing.T) {
+	f := newFrequencySketch(64 * KB)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				f.increment(1)
+				_ = f.estimate(1)
+			}
+		}()
+	}
+	wg.Wait()
+	// the increments lost to the races don't matter, the counter is saturated anyway
+	if e := f.estimate(1); e != sketchMaxCount {
+		t.Fatalf("expected the counter is saturated, got %d", e)
+	}
+}
+
+// hitRatio replays the zipf trace interrupted by the scans of keys read once, the key missing is set at once.
+func hitRatio(t *testing.T, config Config) float64 {
+	tip, err := NewTipTop(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	value := bytes.Repeat([]byte("a"), 64)
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, 1<<16)
+
+	var hits, reads int
+	for i := 0; i < 50000; i++ {
+		key := fmt.Sprintf("key-%d", zipf.Uint64())
+		if i%5000 == 0 {
+			for j := 0; j < 2000; j++ {
+				_ = tip.Set(fmt.Sprintf("scan-%d-%d", i, j), value)
+			}
+		}
+		reads++
+		if _, err := tip.Get(key); err == nil {
+			hits++
+		} else if err := tip.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return float64(hits) / float64(reads)
+}
+
+func TestTipTop_Admission(t *testing.T) {
+	config := Config{
+		ShardSize:    4,
+		MaxCacheSize: 4 * 32 * KB,
+		OnRemove:     true,
+	}
+	fifo := hitRatio(t, config)
+	config.Admission = true
+	tinyLFU := hitRatio(t, config)
+	if tinyLFU <= fifo {
+		t.Fatalf("expected the admission improves the hit ratio, got %.4f with admission, %.4f without", tinyLFU, fifo)
+	}
+	t.Logf("hit ratio %.4f with admission, %.4f without", tinyLFU, fifo)
+
+	if _, err := NewTipTop(Config{ShardSize: 1, Admission: true, OnRemove: true}); err == nil {
+		t.Fatal("expected error without max cache size")
+	}
+	// the window of 1% of the shard would be 0, which is unlimited
+	if _, err := NewTipTop(Config{ShardSize: 16, MaxCacheSize: KB, Admission: true, OnRemove: true}); err == nil {
+		t.Fatal("expected error with the window of 0 byte")
+	}
+}
+
+func TestTipTop_AdmissionWindow(t *testing.T) {
+	tip, err := NewTipTop(Config{
+		ShardSize:    1,
+		MaxCacheSize: 64 * KB,
+		OnRemove:     true,
+		Admission:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	value := bytes.Repeat([]byte("a"), 64)
+
+	// the hot key is admitted after it leaves the window
+	_ = tip.Set("hot", value)
+	for i := 0; i < 2000; i++ {
+		_ = tip.Set(fmt.Sprintf("key-%d", i), value)
+		if got, err := tip.Get("hot"); err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("unexpected %q, %v at %d", got, err, i)
+		}
+	}
+	if tip.GetStats().Rejections == 0 {
+		t.Fatal("expected the keys read once are rejected")
+	}
+
+	// the entries in the window and the queue are both readable and deletable
+	if err := tip.Delete("key-1999"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tip.Get("key-1999"); err != errKeyNotFound {
+		t.Fatalf("expected errKeyNotFound, got %v", err)
+	}
+	tip.Reset()
+	if tip.Len() != 0 {
+		t.Fatalf("expected empty, got %d", tip.Len())
+	}
+}
+
+func TestTipTop_AdmissionMaxEntries(t *testing.T) {
+	tip, err := NewTipTop(Config{
+		ShardSize:    1,
+		MaxCacheSize: 64 * KB,
+		MaxEntries:   2,
+		OnRemove:     true,
+		Admission:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	// the entries are all in the window while the queue is empty, the oldest of which are removed for the limit
+	for i := 0; i < 5; i++ {
+		_ = tip.Set(fmt.Sprintf("key-%d", i), []byte("value"))
+	}
+	if tip.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", tip.Len())
+	}
+	if _, err := tip.Get("key-4"); err != nil {
+		t.Fatalf("expected the newest key is kept, got %v", err)
+	}
+	if tip.GetStats().CountEvictions != 3 {
+		t.Fatalf("unexpected stats %+v", tip.GetStats())
+	}
+}
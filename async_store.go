@@ -0,0 +1,344 @@
+package tiptop
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultDemotionQueueSize = 4096
+	DefaultDemotionBatchSize = 64
+)
+
+// errQueueFull is returned by asyncStore.Set when the entry is dropped by DemotionDropNewest.
+var errQueueFull = errors.New("queue of asynchronous demotion is full")
+
+// DemotionPolicy decides what to do with the demoted entry when the queue of asynchronous demotion is full.
+type DemotionPolicy int
+
+const (
+	// DemotionBlock waits until the queue has room, which slows down the set of shard as backpressure.
+	DemotionBlock DemotionPolicy = iota
+	// DemotionDropNewest drops the entry being demoted.
+	DemotionDropNewest
+	// DemotionDropOldest drops the oldest entry in the queue to make room for the entry being demoted.
+	DemotionDropOldest
+)
+
+// asyncStore is the SecondaryStore queuing the entries to be set, which are written to the underlying
+// store by a background writer in batches, so the shard doesn't wait for the secondary cache under its lock.
+// The queued entries can still be read before they are written. If the interval is set, the writer
+// waits for the batch until the interval passes, and only the latest entry of a key is written.
+// The deletions of deleteLater are kept as the pending entries without value, which don't take the room of queue.
+type asyncStore struct {
+	SecondaryStore
+
+	queue     chan *StoreEntry
+	policy    DemotionPolicy
+	batchSize int
+	interval  time.Duration
+	// writeBehind reports whether the entries queued are written by WriteBehind rather than demoted.
+	writeBehind bool
+
+	// lock protects pending, which keeps the latest queued entry of every key, and deletions, which keeps
+	// the deletions not written yet. The writer is woken by wake once a deletion is added.
+	lock      sync.Mutex
+	pending   map[string]*StoreEntry
+	deletions map[string]*StoreEntry
+	wake      chan struct{}
+	// writing serializes the writer with Delete and Reset, so the entry deleted won't be written back.
+	writing sync.Mutex
+	// closing protects the queue from being sent after it is closed.
+	closing sync.RWMutex
+	closed  bool
+	done    chan struct{}
+
+	queued  int64
+	dropped int64
+	flushed int64
+	failed  int64
+}
+
+func newAsyncStore(store SecondaryStore, config *Config) *asyncStore {
+	queueSize := DefaultDemotionQueueSize
+	if config.DemotionQueueSize > 0 {
+		queueSize = config.DemotionQueueSize
+	}
+	batchSize := DefaultDemotionBatchSize
+	if config.DemotionBatchSize > 0 {
+		batchSize = config.DemotionBatchSize
+	}
+	a := &asyncStore{
+		SecondaryStore: store,
+		queue:          make(chan *StoreEntry, queueSize),
+		policy:         config.DemotionPolicy,
+		batchSize:      batchSize,
+		pending:        make(map[string]*StoreEntry),
+		deletions:      make(map[string]*StoreEntry),
+		wake:           make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	if config.WriteMode == WriteBehind {
+		a.interval = config.WriteBehindInterval
+		a.writeBehind = true
+	}
+	go a.run()
+	return a
+}
+
+func (a *asyncStore) Get(key string, hash uint64) ([]byte, error) {
+	a.lock.Lock()
+	e, ok := a.pending[key]
+	a.lock.Unlock()
+	if ok && e.Entry == nil {
+		return nil, errKeyNotFound
+	}
+	if ok {
+		return e.Entry, nil
+	}
+	return a.SecondaryStore.Get(key, hash)
+}
+
+// Set queues the entry, errQueueFull is returned if the entry is dropped since the queue is full.
+func (a *asyncStore) Set(key string, hash uint64, entry []byte, expiration time.Duration) error {
+	e := &StoreEntry{
+		Key:        key,
+		Hash:       hash,
+		Entry:      entry,
+		Expiration: expiration,
+	}
+
+	a.closing.RLock()
+	defer a.closing.RUnlock()
+	if a.closed {
+		return a.SecondaryStore.Set(key, hash, entry, expiration)
+	}
+
+	a.lock.Lock()
+	a.pending[key] = e
+	a.lock.Unlock()
+
+	if !a.enqueue(e) {
+		a.drop(e)
+		return errQueueFull
+	}
+	atomic.AddInt64(&a.queued, 1)
+	return nil
+}
+
+// deleteLater deletes the key by the writer, so the caller doesn't wait for the underlying store. The deletion
+// is never dropped as the entries, or the former entry of the key would be read back.
+func (a *asyncStore) deleteLater(key string, hash uint64) error {
+	e := &StoreEntry{Key: key, Hash: hash}
+
+	a.closing.RLock()
+	defer a.closing.RUnlock()
+	if a.closed {
+		return a.SecondaryStore.Delete(key, hash)
+	}
+
+	a.lock.Lock()
+	a.pending[key] = e
+	a.deletions[key] = e
+	a.lock.Unlock()
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// enqueue sends the entry to the queue by the policy, and reports whether it is queued.
+func (a *asyncStore) enqueue(e *StoreEntry) bool {
+	switch a.policy {
+	case DemotionDropNewest:
+		select {
+		case a.queue <- e:
+			return true
+		default:
+			return false
+		}
+	case DemotionDropOldest:
+		for {
+			select {
+			case a.queue <- e:
+				return true
+			default:
+			}
+			select {
+			case oldest := <-a.queue:
+				a.drop(oldest)
+			default:
+			}
+		}
+	default:
+		a.queue <- e
+		return true
+	}
+}
+
+// drop gives up the entry which won't be written.
+func (a *asyncStore) drop(e *StoreEntry) {
+	a.lock.Lock()
+	if a.pending[e.Key] == e {
+		delete(a.pending, e.Key)
+	}
+	a.lock.Unlock()
+	atomic.AddInt64(&a.dropped, 1)
+}
+
+func (a *asyncStore) Delete(key string, hash uint64) error {
+	a.writing.Lock()
+	defer a.writing.Unlock()
+
+	a.lock.Lock()
+	delete(a.pending, key)
+	a.lock.Unlock()
+	return a.SecondaryStore.Delete(key, hash)
+}
+
+func (a *asyncStore) Exists(key string, hash uint64) (bool, error) {
+	a.lock.Lock()
+	e, ok := a.pending[key]
+	a.lock.Unlock()
+	if ok {
+		return e.Entry != nil, nil
+	}
+	return a.SecondaryStore.Exists(key, hash)
+}
+
+// Reset gives up all queued entries and resets the underlying store.
+func (a *asyncStore) Reset() error {
+	a.writing.Lock()
+	defer a.writing.Unlock()
+
+	a.lock.Lock()
+	a.pending = make(map[string]*StoreEntry)
+	a.deletions = make(map[string]*StoreEntry)
+	a.lock.Unlock()
+	return a.SecondaryStore.Reset()
+}
+
+// Close writes all queued entries and stops the writer, the underlying store is left open.
+func (a *asyncStore) Close() error {
+	a.closing.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.closing.Unlock()
+	<-a.done
+	return nil
+}
+
+// run writes the queued entries in batches until the queue is closed.
+func (a *asyncStore) run() {
+	defer close(a.done)
+
+	var tick <-chan time.Time
+	if a.interval > 0 {
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	batch := make([]*StoreEntry, 0, a.batchSize)
+	for {
+		select {
+		case e, ok := <-a.queue:
+			if !ok {
+				a.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			// without the interval, the batch is written as soon as no more entry is queued.
+			if len(batch) < a.batchSize && (tick != nil || len(a.queue) > 0) {
+				continue
+			}
+		case <-a.wake:
+		case <-tick:
+		}
+		a.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush writes the deletions, and the entries which are still the latest of their keys.
+func (a *asyncStore) flush(batch []*StoreEntry) {
+	a.writing.Lock()
+	defer a.writing.Unlock()
+
+	entries := make([]StoreEntry, 0, len(batch))
+	a.lock.Lock()
+	var deletions map[string]*StoreEntry
+	if len(a.deletions) > 0 {
+		deletions, a.deletions = a.deletions, make(map[string]*StoreEntry)
+	}
+	for _, e := range batch {
+		if a.pending[e.Key] == e {
+			entries = append(entries, *e)
+		}
+	}
+	a.lock.Unlock()
+
+	for key, e := range deletions {
+		_ = a.SecondaryStore.Delete(key, e.Hash)
+		a.lock.Lock()
+		if a.pending[key] == e {
+			delete(a.pending, key)
+		}
+		a.lock.Unlock()
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	// the entries failed to write are given up, all entries of the batch are failed if SetBatch fails.
+	failed := 0
+	if store, ok := a.SecondaryStore.(BatchStore); ok {
+		if err := store.SetBatch(entries); err != nil {
+			failed = len(entries)
+		}
+	} else {
+		for _, e := range entries {
+			if err := a.SecondaryStore.Set(e.Key, e.Hash, e.Entry, e.Expiration); err != nil {
+				failed++
+			}
+		}
+	}
+
+	a.release(batch)
+	atomic.AddInt64(&a.flushed, int64(len(entries)-failed))
+	atomic.AddInt64(&a.failed, int64(failed))
+}
+
+// release removes the entries of the batch written from pending, unless they are replaced by the later ones.
+func (a *asyncStore) release(batch []*StoreEntry) {
+	a.lock.Lock()
+	for _, e := range batch {
+		if a.pending[e.Key] == e {
+			delete(a.pending, e.Key)
+		}
+	}
+	a.lock.Unlock()
+}
+
+func (a *asyncStore) getStats() Stats {
+	if a.writeBehind {
+		return Stats{
+			WriteBehindQueued:  atomic.LoadInt64(&a.queued),
+			WriteBehindDropped: atomic.LoadInt64(&a.dropped),
+			WriteBehindFlushed: atomic.LoadInt64(&a.flushed),
+			WriteBehindFailed:  atomic.LoadInt64(&a.failed),
+		}
+	}
+	return Stats{
+		DemotionQueued:  atomic.LoadInt64(&a.queued),
+		DemotionDropped: atomic.LoadInt64(&a.dropped),
+		DemotionFlushed: atomic.LoadInt64(&a.flushed),
+		DemotionFailed:  atomic.LoadInt64(&a.failed),
+	}
+}
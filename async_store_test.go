@@ -0,0 +1,193 @@
+package tiptop
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingStore is a memoryStore whose Set waits until it is released.
+type blockingStore struct {
+	*memoryStore
+	release chan struct{}
+}
+
+func (b *blockingStore) Set(key string, hash uint64, entry []byte, expiration time.Duration) error {
+	<-b.release
+	return b.memoryStore.Set(key, hash, entry, expiration)
+}
+
+func TestAsyncStore_Demotion(t *testing.T) {
+	store := newMemoryStore()
+	tip, err := NewTipTop(Config{
+		ShardSize:      1,
+		MaxCacheSize:   KB,
+		SecondaryStore: store,
+		OnRemove:       true,
+		AsyncDemotion:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 20; i++ {
+		_ = tip.Set(fmt.Sprintf("key-%d", i), value)
+	}
+	for i := 0; i < 20; i++ {
+		if got, err := tip.Get(fmt.Sprintf("key-%d", i)); err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("unexpected key-%d %q, %v", i, got, err)
+		}
+	}
+
+	_ = tip.Close()
+	stats := tip.GetStats()
+	if stats.DemotionQueued == 0 || stats.DemotionDropped != 0 || stats.DemotionFlushed > stats.DemotionQueued {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if tip.Len()+store.len() != 20 {
+		t.Fatalf("expected all entries are kept, in-memory %d, store %d", tip.Len(), store.len())
+	}
+}
+
+func TestAsyncStore_Pending(t *testing.T) {
+	store := &blockingStore{memoryStore: newMemoryStore(), release: make(chan struct{})}
+	async := newAsyncStore(store, &Config{})
+
+	_ = async.Set("key-0", 0, []byte("value-0"), 0)
+	_ = async.Set("key-1", 0, []byte("value-1"), 0)
+	// the queued entries are read before written
+	if got, err := async.Get("key-1", 0); err != nil || string(got) != "value-1" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if ok, _ := async.Exists("key-1", 0); !ok {
+		t.Fatal("expected the queued key exists")
+	}
+
+	// the deleted entry is not left in the store whenever it is deleted
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = async.Delete("key-1", 0)
+	}()
+	close(store.release)
+	wg.Wait()
+	_ = async.Close()
+
+	if got, err := store.Get("key-0", 0); err != nil || string(got) != "value-0" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if ok, _ := store.Exists("key-1", 0); ok {
+		t.Fatal("expected the deleted key doesn't exist")
+	}
+	if stats := async.getStats(); stats.DemotionQueued != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestAsyncStore_DeleteLater(t *testing.T) {
+	store := &blockingStore{memoryStore: newMemoryStore(), release: make(chan struct{})}
+	async := newAsyncStore(store, &Config{DemotionQueueSize: 1, DemotionBatchSize: 1})
+	_ = store.memoryStore.Set("key", 0, []byte("former"), 0)
+
+	// the writer is blocked with the entry, and the deletion doesn't wait for it or take the room of queue
+	_ = async.Set("other", 0, []byte("value"), 0)
+	_ = async.Set("blocked", 0, []byte("value"), 0)
+	if err := async.deleteLater("key", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := async.Get("key", 0); err == nil {
+		t.Fatal("expected the key deleted isn't read")
+	}
+	if ok, _ := async.Exists("key", 0); ok {
+		t.Fatal("expected the key deleted doesn't exist")
+	}
+
+	close(store.release)
+	_ = async.Close()
+	if ok, _ := store.Exists("key", 0); ok {
+		t.Fatal("expected the key is deleted from the store")
+	}
+	if stats := async.getStats(); stats.DemotionQueued != 2 || stats.DemotionDropped != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestAsyncStore_DropPolicy(t *testing.T) {
+	for _, policy := range []DemotionPolicy{DemotionDropNewest, DemotionDropOldest} {
+		store := &blockingStore{memoryStore: newMemoryStore(), release: make(chan struct{})}
+		async := newAsyncStore(store, &Config{
+			DemotionQueueSize: 1,
+			DemotionBatchSize: 1,
+			DemotionPolicy:    policy,
+		})
+		for i := 0; i < 10; i++ {
+			_ = async.Set(fmt.Sprintf("key-%d", i), 0, []byte("value"), 0)
+		}
+		close(store.release)
+		_ = async.Close()
+
+		stats := async.getStats()
+		if stats.DemotionDropped == 0 || stats.DemotionFlushed+stats.DemotionDropped != 10 {
+			t.Fatalf("policy %d: unexpected stats %+v", policy, stats)
+		}
+		if policy == DemotionDropOldest {
+			if _, err := store.Get("key-9", 0); err != nil {
+				t.Fatal("expected the newest entry is kept")
+			}
+		}
+	}
+}
+
+// failingStore is a memoryStore whose writes of the keys prefixed by "fail" fail.
+type failingStore struct {
+	*memoryStore
+}
+
+func (f *failingStore) Set(key string, hash uint64, entry []byte, expiration time.Duration) error {
+	if strings.HasPrefix(key, "fail") {
+		return errors.New("failed to set")
+	}
+	return f.memoryStore.Set(key, hash, entry, expiration)
+}
+
+// failingBatchStore is a failingStore whose batches fail if any key fails.
+type failingBatchStore struct {
+	failingStore
+}
+
+func (f *failingBatchStore) SetBatch(entries []StoreEntry) error {
+	for _, e := range entries {
+		if err := f.Set(e.Key, e.Hash, e.Entry, e.Expiration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestAsyncStore_Failed(t *testing.T) {
+	for _, store := range []SecondaryStore{
+		&failingStore{memoryStore: newMemoryStore()},
+		&failingBatchStore{failingStore{memoryStore: newMemoryStore()}},
+	} {
+		async := newAsyncStore(store, &Config{WriteMode: WriteBehind, WriteBehindInterval: time.Hour})
+		_ = async.Set("key", 0, []byte("value"), 0)
+		_ = async.Set("fail", 0, []byte("value"), 0)
+		_ = async.Close()
+
+		stats := async.getStats()
+		if _, ok := store.(BatchStore); ok {
+			// the whole batch is failed
+			if stats.WriteBehindFlushed != 0 || stats.WriteBehindFailed != 2 {
+				t.Fatalf("unexpected stats of batch %+v", stats)
+			}
+		} else if stats.WriteBehindFlushed != 1 || stats.WriteBehindFailed != 1 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package tiptop
+
+import "sync/atomic"
+
+// memoryBudget is the max bytes of the live entries shared by all shards.
+type memoryBudget struct {
+	limit int64
+	// share is the bytes of every shard if the budget is divided evenly, the shards beyond
+	// their share are trimmed first.
+	share int
+	live  int64
+}
+
+func newMemoryBudget(limit int, shards int) *memoryBudget {
+	return &memoryBudget{
+		limit: int64(limit),
+		share: limit / shards,
+	}
+}
+
+func (b *memoryBudget) add(n int) {
+	atomic.AddInt64(&b.live, int64(n))
+}
+
+func (b *memoryBudget) exceeded() bool {
+	return atomic.LoadInt64(&b.live) > b.limit
+}
+
+// account adds n to the live bytes of the shard and the budget. It must be called with the lock held.
+func (s *shard) account(n int) {
+	s.live += n
+	if s.budget != nil {
+		s.budget.add(n)
+	}
+}
+
+// evictOverBudget removes the oldest entries except the one of the hash, while the memory budget is exceeded
+// and the shard takes more than its share. The shard within its share doesn't remove its entries for the
+// others, which are trimmed in background. It must be called with the lock held.
+func (s *shard) evictOverBudget(hash uint64) {
+	for s.budget.exceeded() && s.live > s.budget.share {
+		if victim := s.victim(); victim == 0 || victim == hash || s.removeVictim() != nil {
+			return
+		}
+	}
+}
+
+// trim removes the oldest entries while the memory budget is exceeded and the shard takes more than its share.
+func (s *shard) trim() {
+	s.lock.Lock()
+	defer s.unlock()
+
+	s.evictOverBudget(0)
+}
+
+// evictOverCount removes the oldest entries except the one of the hash, while the shard keeps more
+// entries than maxEntries. It must be called with the lock held.
+func (s *shard) evictOverCount(hash uint64) {
+	for len(s.marker) > s.maxEntries {
+		if victim := s.victim(); victim == 0 || victim == hash || s.removeVictim() != nil {
+			return
+		}
+		s.statsCountEviction()
+	}
+}
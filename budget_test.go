@@ -0,0 +1,126 @@
+package tiptop
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// keysOfShard returns n keys stored in the shard of index.
+func keysOfShard(tip *TipTop, index int, n int) []string {
+	keys := make([]string, 0, n)
+	for i := 0; len(keys) < n; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if tip.getShard(tip.hash.sum64(key)) == tip.shards[index] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestTipTop_MemoryBudget(t *testing.T) {
+	tip, err := NewTipTop(Config{
+		ShardSize:    4,
+		MemoryBudget: 16 * KB,
+		OnRemove:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	value := bytes.Repeat([]byte("a"), 100)
+
+	// the hot shard takes more than the even share
+	hot := keysOfShard(tip, 0, 300)
+	for _, key := range hot {
+		_ = tip.Set(key, value)
+	}
+	if live := tip.LiveBytes(); live > 16*KB || tip.shards[0].liveBytes() < 12*KB {
+		t.Fatalf("unexpected live bytes %d of all, %d of the hot shard", live, tip.shards[0].liveBytes())
+	}
+	if _, err := tip.Get(hot[len(hot)-1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tip.Get(hot[0]); err != errKeyNotFound {
+		t.Fatalf("expected the oldest entry is removed, got %v", err)
+	}
+
+	// the shard within its share doesn't remove its entries, the hot one is trimmed in background
+	cold := keysOfShard(tip, 1, 20)
+	for _, key := range cold {
+		_ = tip.Set(key, value)
+	}
+	if tip.LiveBytes() <= 16*KB {
+		t.Fatalf("expected the budget is exceeded, got %d", tip.LiveBytes())
+	}
+	tip.trim()
+	if live := tip.LiveBytes(); live > 16*KB {
+		t.Fatalf("expected the budget is kept, got %d", live)
+	}
+	for _, key := range cold {
+		if _, err := tip.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if overhead := tip.Overhead(); overhead <= 0 || overhead >= tip.AllocatedBytes() {
+		t.Fatalf("unexpected overhead %d of %d", overhead, tip.AllocatedBytes())
+	}
+	expected := 0
+	for _, key := range cold {
+		expected += len(key) + len(value) + headersSizeInBytes + headerEntrySize
+	}
+	if live := tip.shards[1].liveBytes(); live != expected {
+		t.Fatalf("expected %d live bytes, got %d", expected, live)
+	}
+
+	tip.Reset()
+	if tip.LiveBytes() != 0 || tip.budget.live != 0 {
+		t.Fatalf("expected no live bytes, got %d, %d", tip.LiveBytes(), tip.budget.live)
+	}
+}
+
+func TestTipTop_MaxEntries(t *testing.T) {
+	for _, policy := range []EvictionPolicy{EvictFIFO, EvictLRU, EvictClock} {
+		tip, err := NewTipTop(Config{
+			ShardSize:      4,
+			MaxEntries:     100,
+			OnRemove:       true,
+			EvictionPolicy: policy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := keysOfShard(tip, 0, 50)
+		for _, key := range keys {
+			_ = tip.Set(key, []byte("v"))
+			// the overwrite doesn't count
+			_ = tip.Set(key, []byte("v"))
+		}
+		if tip.Len() != 25 || tip.GetStats().CountEvictions != 25 {
+			t.Fatalf("expected 25 entries, got %d, stats %+v", tip.Len(), tip.GetStats())
+		}
+		for i, key := range keys {
+			_, err := tip.Get(key)
+			if i < 25 && err != errKeyNotFound || i >= 25 && err != nil {
+				t.Fatalf("unexpected %v of the %dth key with policy %d", err, i, policy)
+			}
+		}
+		_ = tip.Close()
+	}
+
+	// the new key can't be set without OnRemove
+	tip, err := NewTipTop(Config{ShardSize: 1, MaxEntries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	_ = tip.Set("a", []byte("v"))
+	_ = tip.Set("b", []byte("v"))
+	if err := tip.Set("c", []byte("v")); err != errMaxEntry {
+		t.Fatalf("expected errMaxEntry, got %v", err)
+	}
+	if err := tip.Set("a", []byte("w")); err != nil || tip.Len() != 2 {
+		t.Fatalf("unexpected %v, %d entries", err, tip.Len())
+	}
+}
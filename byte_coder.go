@@ -2,44 +2,147 @@ package tiptop
 
 import (
 	"encoding/binary"
+	"time"
 )
 
 const (
-	timestampSizeInBytes = 8                                                         // Number of bytes used for timestamp
-	hashSizeInBytes      = 8                                                         // Number of bytes used for sum64
-	crc32SizeInBytes     = 4                                                         // Number of bytes used for CRC32
-	headersSizeInBytes   = timestampSizeInBytes + hashSizeInBytes + crc32SizeInBytes // Number of bytes used for all headers
+	timestampSizeInBytes = 8                                                                          // Number of bytes used for timestamp
+	hashSizeInBytes      = 8                                                                          // Number of bytes used for sum64
+	crc32SizeInBytes     = 4                                                                          // Number of bytes used for CRC32
+	keySizeInBytes       = 2                                                                          // Number of bytes used for size of key
+	periodSizeInBytes    = 8                                                                          // Number of bytes used for ttl of entry
+	headersSizeInBytes   = timestampSizeInBytes + hashSizeInBytes + crc32SizeInBytes + keySizeInBytes // Number of bytes used for all headers
+
+	legacyHeadersSizeInBytes = timestampSizeInBytes + hashSizeInBytes + crc32SizeInBytes // Number of bytes used for headers of the former version
+
+	maxKeySize = 1<<(8*keySizeInBytes) - 1 // Max size of key in bytes
+
+	// the flags are kept in the highest byte of timestamp, which is 0 in the entries without flags.
+	flagsShift    = 8 * (timestampSizeInBytes - 1)
+	timestampMask = 1<<flagsShift - 1
 )
 
-// wrapEntry pack the []byte with expiration, the sha1 and crc32 of the key.
-func wrapEntry(timestamp int64, hash uint64, crc32 uint32, entry []byte, buffer *[]byte) []byte {
-	blobLength := len(entry) + headersSizeInBytes
+const (
+	// flagMissing marks the negative entry of the key known to be missing, which has no value.
+	flagMissing byte = 1 << iota
+	// flagVisited marks the entry read since it is pushed, which is requeued instead of removed by EvictClock.
+	flagVisited
+	// flagVersion marks the entry of the current layout, whose timestamp is in milliseconds and whose key follows
+	// the headers. The entries without it are written by the former version and may be still kept by the secondary
+	// cache, whose timestamp is in seconds and whose value follows the headers of legacyHeadersSizeInBytes.
+	// The former timestamp in seconds never reaches the highest byte, so the bit is never set in them.
+	flagVersion
+	// flagSliding marks the entry of sliding expiration, whose idle period is the ttl following the key.
+	flagSliding
+	// flagPeriod marks the entry whose ttl in milliseconds follows the key.
+	flagPeriod
+)
+
+// wrapEntry pack the []byte with expiration in milliseconds and flags, the sha1 and crc32 of the key, and the key itself.
+// The ttl in milliseconds is kept after the key if the period is greater than 0, which is the ttl the entry is set with,
+// and the idle period of the entry marked by flagSliding.
+func wrapEntry(timestamp int64, flags byte, period int64, hash uint64, crc32 uint32, key string, entry []byte, buffer *[]byte) []byte {
+	blobLength := len(entry) + len(key) + headersSizeInBytes
+	if period > 0 {
+		flags |= flagPeriod
+		blobLength += periodSizeInBytes
+	} else {
+		flags &^= flagPeriod | flagSliding
+	}
 
 	if blobLength > len(*buffer) {
 		*buffer = make([]byte, blobLength)
 	}
 	blob := *buffer
 
-	binary.LittleEndian.PutUint64(blob, uint64(timestamp))
+	binary.LittleEndian.PutUint64(blob, uint64(timestamp)&timestampMask|uint64(flags|flagVersion)<<flagsShift)
 	binary.LittleEndian.PutUint64(blob[timestampSizeInBytes:], hash)
 	binary.LittleEndian.PutUint32(blob[timestampSizeInBytes+hashSizeInBytes:], crc32)
-	copy(blob[headersSizeInBytes:], entry)
+	binary.LittleEndian.PutUint16(blob[timestampSizeInBytes+hashSizeInBytes+crc32SizeInBytes:], uint16(len(key)))
+	copy(blob[headersSizeInBytes:], key)
+	offset := headersSizeInBytes + len(key)
+	if period > 0 {
+		binary.LittleEndian.PutUint64(blob[offset:], uint64(period))
+		offset += periodSizeInBytes
+	}
+	copy(blob[offset:], entry)
 
 	return blob[:blobLength]
 }
 
+// upgradeEntry converts the package of []byte written by the former version to the current layout with the key,
+// the package of current layout is returned as is. nil is returned if it is too short to hold the former headers.
+func upgradeEntry(key string, data []byte) []byte {
+	if len(data) < legacyHeadersSizeInBytes {
+		return nil
+	}
+	if readFlagsFromEntry(data)&flagVersion != 0 {
+		return data
+	}
+	timestamp := int64(binary.LittleEndian.Uint64(data)) * int64(time.Second/time.Millisecond)
+	var buffer []byte
+	return wrapEntry(timestamp, 0, 0, readHashFromEntry(data), readCRC32FromEntry(data), key, data[legacyHeadersSizeInBytes:], &buffer)
+}
+
+// validEntry reports whether the package of []byte is long enough to hold the headers, the key and the ttl.
+func validEntry(data []byte) bool {
+	return len(data) >= headersSizeInBytes && len(data) >= valueOffset(data)
+}
+
+// valueOffset returns the offset of the value in the package of []byte
+func valueOffset(data []byte) int {
+	offset := headersSizeInBytes + readKeySizeFromEntry(data)
+	if readFlagsFromEntry(data)&flagPeriod != 0 {
+		offset += periodSizeInBytes
+	}
+	return offset
+}
+
 // readEntry read the value from the package of []byte
 func readEntry(data []byte) []byte {
+	offset := valueOffset(data)
 	// copy on read
-	dst := make([]byte, len(data)-headersSizeInBytes)
-	copy(dst, data[headersSizeInBytes:])
+	dst := make([]byte, len(data)-offset)
+	copy(dst, data[offset:])
 
 	return dst
 }
 
-// readTimestampFromEntry read the expiration from the package of []byte
+// readKeyFromEntry read the key from the package of []byte
+func readKeyFromEntry(data []byte) string {
+	return string(data[headersSizeInBytes : headersSizeInBytes+readKeySizeFromEntry(data)])
+}
+
+// readKeySizeFromEntry read the size of key from the package of []byte
+func readKeySizeFromEntry(data []byte) int {
+	return int(binary.LittleEndian.Uint16(data[timestampSizeInBytes+hashSizeInBytes+crc32SizeInBytes:]))
+}
+
+// readTimestampFromEntry read the expiration in milliseconds from the package of []byte
 func readTimestampFromEntry(data []byte) int64 {
-	return int64(binary.LittleEndian.Uint64(data))
+	return int64(binary.LittleEndian.Uint64(data) & timestampMask)
+}
+
+// readPeriodFromEntry read the ttl in milliseconds from the package of []byte, 0 if it is not kept.
+func readPeriodFromEntry(data []byte) int64 {
+	if readFlagsFromEntry(data)&flagPeriod == 0 {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(data[headersSizeInBytes+readKeySizeFromEntry(data):]))
+}
+
+// readIdleFromEntry read the idle period in milliseconds of the sliding entry from the package of []byte,
+// 0 if the entry is not sliding.
+func readIdleFromEntry(data []byte) int64 {
+	if readFlagsFromEntry(data)&flagSliding == 0 {
+		return 0
+	}
+	return readPeriodFromEntry(data)
+}
+
+// readFlagsFromEntry read the flags from the package of []byte
+func readFlagsFromEntry(data []byte) byte {
+	return data[timestampSizeInBytes-1]
 }
 
 // readHashFromEntry read the sha1 from the package of []byte
@@ -52,6 +155,17 @@ func readCRC32FromEntry(data []byte) uint32 {
 	return binary.LittleEndian.Uint32(data[timestampSizeInBytes+hashSizeInBytes:])
 }
 
+// writeFlagsToEntry overwrite the flags of the package of []byte
+func writeFlagsToEntry(data []byte, flags byte) {
+	data[timestampSizeInBytes-1] = flags
+}
+
+// writeTimestampToEntry overwrite the expiration in milliseconds of the package of []byte, the flags are kept
+func writeTimestampToEntry(data []byte, timestamp int64) {
+	flags := readFlagsFromEntry(data) | flagVersion
+	binary.LittleEndian.PutUint64(data, uint64(timestamp)&timestampMask|uint64(flags)<<flagsShift)
+}
+
 // resetKeyFromEntry reset the hash of the package of []byte
 func resetKeyFromEntry(data []byte) {
 	binary.LittleEndian.PutUint64(data[timestampSizeInBytes:], 0)
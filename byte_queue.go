@@ -103,6 +103,29 @@ func (q *ByteQueue) Pop() ([]byte, error) {
 	return data, nil
 }
 
+// Rotate moves the oldest entry to the end of queue and returns its new index, the space of queue is not
+// allocated for it. If there is no room to move the entry, errFullQueue is returned and queue is unchanged.
+func (q *ByteQueue) Rotate() (int, error) {
+	head, tail, rightMargin, count := q.head, q.tail, q.rightMargin, q.count
+	data, err := q.Pop()
+	if err != nil {
+		return -1, err
+	}
+
+	totalLen := len(data) + headerEntrySize
+	if q.availableSpaceAfterTail() < totalLen {
+		if q.availableSpaceBeforeHead() < totalLen {
+			q.head, q.tail, q.rightMargin, q.count = head, tail, rightMargin, count
+			return -1, errFullQueue
+		}
+		q.tail = leftMarginIndex
+	}
+	// the entry is never moved to the right of itself, so it is not overwritten before it is copied.
+	index := q.tail
+	q.push(data, len(data))
+	return index, nil
+}
+
 // Get reads entry from index
 func (q *ByteQueue) Get(index int) ([]byte, error) {
 	data, _, err := q.getWithLength(index)
@@ -206,6 +229,25 @@ func (q *ByteQueue) peekCheckErr(index int) error {
 	return nil
 }
 
+// Size returns number of bytes used by the entries kept in queue, including their headers
+func (q *ByteQueue) Size() int {
+	if q.count == 0 {
+		return 0
+	}
+	if q.tail > q.head {
+		return q.tail - q.head
+	}
+	return q.rightMargin - q.head + q.tail - leftMarginIndex
+}
+
+// Offset returns number of bytes from the head to the entry of index, the oldest entry is at 0
+func (q *ByteQueue) Offset(index int) int {
+	if index >= q.head {
+		return index - q.head
+	}
+	return q.rightMargin - q.head + index - leftMarginIndex
+}
+
 // Capacity returns number of allocated bytes for queue
 func (q *ByteQueue) Capacity() int {
 	return q.capacity
@@ -2,25 +2,59 @@ package tiptop
 
 import "time"
 
+// Clock provides the current time to the expiration of entries, which is set by Config.Clock.
+// The clocktest package provides a Clock advanced manually by the tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock of the system time.
+type systemClock struct {
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// clock provides the timestamps of expiration in milliseconds.
 type clock interface {
 	epoch() int64
 	exp(ttl time.Duration) int64
+	ttl(timestamp int64) (time.Duration, bool)
 }
 
-func newDefaultClock() clock {
-	return defaultClock{}
+func newDefaultClock(source Clock) clock {
+	return defaultClock{source: source}
 }
 
 type defaultClock struct {
+	source Clock
 }
 
 func (c defaultClock) epoch() int64 {
-	return time.Now().Unix()
+	return unixMilli(c.source.Now())
 }
 
 func (c defaultClock) exp(ttl time.Duration) int64 {
 	if ttl != 0 {
-		return time.Now().Add(ttl).Unix()
+		return unixMilli(c.source.Now().Add(ttl))
 	}
 	return 0
 }
+
+// ttl returns the remaining time to live of the expiration timestamp,
+// and reports whether the timestamp is not out of date. 0 means never out of date.
+func (c defaultClock) ttl(timestamp int64) (time.Duration, bool) {
+	if timestamp == 0 {
+		return 0, true
+	}
+	if now := c.epoch(); timestamp > now {
+		return time.Duration(timestamp-now) * time.Millisecond, true
+	}
+	return 0, false
+}
+
+// unixMilli returns the time in milliseconds since January 1, 1970 UTC.
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
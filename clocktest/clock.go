@@ -0,0 +1,40 @@
+// Package clocktest provides a Clock which only moves when it is advanced, so the tests of expiration
+// can run without sleeping. It can be set to tiptop.Config.Clock and redistest.Server.SetClock.
+package clocktest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a clock advanced manually, it is safe for concurrent use.
+type Clock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+// NewClock returns a Clock started at now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the current time of the Clock.
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Advance moves the Clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the Clock to now.
+func (c *Clock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+}
@@ -0,0 +1,67 @@
+package tiptop
+
+import "time"
+
+const (
+	DefaultCompactionWindow = time.Second
+	DefaultCompactionBudget = 64 * KB
+
+	// the shard is compacted when the dead bytes exceed the ratio of its queue.
+	compactionRatio = 0.25
+)
+
+// compact reclaims the dead bytes of the queue once they exceed compactionRatio of it, the oldest entries
+// within the budget of bytes are rotated: the dead entries are dropped and the live ones are moved to the end
+// of the queue with their indexes fixed up, so the dead bytes are reused before the live entries are removed
+// for space. The entries moved are removed later than the others, as if they were just pushed.
+// The shard is checked under the read lock first, so the idle shard doesn't block its readers.
+func (s *shard) compact(budget int) {
+	s.lock.RLock()
+	compactable := s.compactable()
+	s.lock.RUnlock()
+	if !compactable {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.unlock()
+
+	if !s.compactable() {
+		return
+	}
+	if size := s.entries.Size(); budget > size {
+		budget = size
+	}
+
+	reclaimed := 0
+	for budget > 0 {
+		oldest, err := s.entries.Peek()
+		if err != nil {
+			break
+		}
+		n := len(oldest) + headerEntrySize
+		if hash := readHashFromEntry(oldest); hash == 0 {
+			_, _ = s.entries.Pop()
+			reclaimed += n
+		} else if index, err := s.entries.Rotate(); err == nil {
+			s.marker[hash] = index
+		} else {
+			break
+		}
+		budget -= n
+	}
+	s.statsReclaimed(reclaimed)
+}
+
+// compactable reports whether the dead bytes exceed compactionRatio of the queue.
+// It must be called with the lock held.
+func (s *shard) compactable() bool {
+	size := s.entries.Size()
+	return size != 0 && float64(s.dead()) >= float64(size)*compactionRatio
+}
+
+// dead returns the bytes of the entries deleted, overwritten or outdated which are still in the queues.
+// It must be called with the lock held.
+func (s *shard) dead() int {
+	return s.entries.Size() + s.window.Size() - s.live
+}
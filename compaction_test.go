@@ -0,0 +1,151 @@
+package tiptop
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestByteQueue_Rotate(t *testing.T) {
+	q := NewByteQueue(64, 64)
+	_, _ = q.Push([]byte("a"))
+	_, _ = q.Push([]byte("bb"))
+	index, err := q.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := q.Get(index); string(got) != "a" {
+		t.Fatalf("unexpected %q", got)
+	}
+	for _, expected := range []string{"bb", "a"} {
+		if got, _ := q.Pop(); string(got) != expected {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+
+	// the queue is unchanged if there is no room
+	q = NewByteQueue(64, 64)
+	_, _ = q.Push(bytes.Repeat([]byte("a"), 20))
+	_, _ = q.Push(bytes.Repeat([]byte("b"), 30))
+	if _, err := q.Rotate(); err != errFullQueue {
+		t.Fatalf("expected errFullQueue, got %v", err)
+	}
+	if got, _ := q.Peek(); !bytes.Equal(got, bytes.Repeat([]byte("a"), 20)) || q.Len() != 2 {
+		t.Fatalf("unexpected %q, %d", got, q.Len())
+	}
+}
+
+// liveBytes sums the bytes of the entries in the marker.
+func liveBytes(s *shard) int {
+	live := 0
+	for _, index := range s.marker {
+		entry, _ := s.getEntry(index)
+		live += len(entry) + headerEntrySize
+	}
+	return live
+}
+
+func TestShard_Compact(t *testing.T) {
+	tip, err := NewTipTop(Config{
+		ShardSize:    1,
+		MaxCacheSize: 8 * KB,
+		OnRemove:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	value := bytes.Repeat([]byte("a"), 64)
+	for i := 0; i < 80; i++ {
+		_ = tip.Set(fmt.Sprintf("key-%d", i), value)
+	}
+	for i := 0; i < 80; i += 2 {
+		_ = tip.Delete(fmt.Sprintf("key-%d", i))
+	}
+	s := tip.shards[0]
+	if s.live != liveBytes(s) || s.dead() == 0 {
+		t.Fatalf("unexpected live %d, dead %d", s.live, s.dead())
+	}
+
+	for i := 0; i < 10; i++ {
+		tip.compact()
+	}
+	if s.dead() != 0 || tip.GetStats().ReclaimedBytes == 0 {
+		t.Fatalf("expected the dead bytes are reclaimed, got %d", s.dead())
+	}
+	live := tip.Len()
+
+	// the space reclaimed is used before the live entries are removed
+	for i := 0; i < live/2; i++ {
+		_ = tip.Set(fmt.Sprintf("new-%d", i), value)
+	}
+	for i := 1; i < 80; i += 2 {
+		if got, err := tip.Get(fmt.Sprintf("key-%d", i)); err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("unexpected %q, %v of key-%d", got, err, i)
+		}
+	}
+}
+
+func TestShard_CompactIdle(t *testing.T) {
+	tip, err := NewTipTop(Config{
+		ShardSize:    1,
+		MaxCacheSize: 8 * KB,
+		OnRemove:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	_ = tip.Set("key", []byte("value"))
+
+	// the shard without work is checked under the read lock, so it doesn't wait for the readers
+	s := tip.shards[0]
+	s.lock.RLock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.compact(DefaultCompactionBudget)
+		s.shrinkIdle(time.Now(), DefaultShrinkPeriod)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the idle shard isn't locked exclusively")
+	}
+	s.lock.RUnlock()
+}
+
+func TestShard_LiveBytes(t *testing.T) {
+	for _, config := range []Config{
+		{ShardSize: 1, MaxCacheSize: 4 * KB, OnRemove: true},
+		{ShardSize: 1, MaxCacheSize: 4 * KB, OnRemove: true, EvictionPolicy: EvictLRU},
+		{ShardSize: 1, MaxCacheSize: 4 * KB, OnRemove: true, EvictionPolicy: EvictClock},
+		{ShardSize: 1, MaxCacheSize: 64 * KB, OnRemove: true, Admission: true},
+	} {
+		tip, err := NewTipTop(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 5000; i++ {
+			key := fmt.Sprintf("key-%d", r.Intn(200))
+			switch r.Intn(4) {
+			case 0:
+				_ = tip.Delete(key)
+			case 1:
+				_, _ = tip.Get(key)
+			default:
+				_ = tip.Set(key, bytes.Repeat([]byte("a"), r.Intn(100)))
+			}
+			if i%500 == 0 {
+				tip.compact()
+			}
+		}
+		if s := tip.shards[0]; s.live != liveBytes(s) {
+			t.Fatalf("expected live %d, got %d with %+v", liveBytes(s), s.live, config)
+		}
+		_ = tip.Close()
+	}
+}
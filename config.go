@@ -9,6 +9,10 @@ const (
 	DefaultCleanWindows  = 30 * time.Minute
 	DefaultShardSize     = 1024
 	DefaultInitEntrySize = 5 * MB
+	DefaultKeyPrefix     = "tiptop::key::"
+	DefaultMissingTTL    = time.Minute
+
+	DefaultWriteBehindInterval = time.Second
 )
 
 // Config provides some environmental parameter to sustain tiptop running.
@@ -18,19 +22,79 @@ type Config struct {
 	ShardSize int
 	// Initialize size of entry in shard.
 	InitEntrySize int
+	// MemoryBudget is the max bytes of the live entries of all shards, including the keys, values and headers.
+	// The shards share the budget instead of dividing it evenly, when it is exceeded the shard being set
+	// removes its oldest entries if it takes more than the even share, otherwise the shards beyond their
+	// share are trimmed in background every CompactionWindow. The memory allocated is bigger than the
+	// budget because of the dead entries and the free space, see TipTop.Overhead. It requires OnRemove.
+	// Default value is set to 0 which mean unlimited size.
+	MemoryBudget int
+	// MaxEntries is the max number of entries of cache, which is divided by the shards. When a shard achieves
+	// its part, the oldest entry is removed by EvictionPolicy if OnRemove is true, otherwise the new key
+	// can't be set. It bounds the memory taken by the hashmap of shard when the values are tiny.
+	// Default value is set to 0 which mean unlimited number.
+	MaxEntries int
 	// Max size of cache in Byte. if the use of cache in in-memory have achieved,
-	// it will remove the entry by FIFO regulation.
+	// it will remove the entry by EvictionPolicy.
 	// Default value is set to 0 which mean unlimited size.
 	MaxCacheSize int
-	// CleanWindow is the period used to remove outdated entry.
+	// EvictionPolicy decides which entry is removed when MaxCacheSize is achieved, see EvictionPolicy.
+	// Default of EvictionPolicy is EvictFIFO.
+	EvictionPolicy EvictionPolicy
+	// When Admission is true, the new entries are kept in a small window of shard at first, then the entry
+	// leaving the window only replaces the oldest entry if it is accessed more often, which is estimated by
+	// the frequency sketch of shard (TinyLFU). So the keys read once, such as a scan, won't flush the cache.
+	// It requires MaxCacheSize and OnRemove, and the share of MaxCacheSize of every shard must be large enough
+	// to hold a window of at least 1 byte, which is 1% of it.
+	Admission bool
+	// CleanWindow is the period used to remove all outdated entries regardless of CleanBudget, which catches up
+	// the entries left by the sweeps when more entries expire than the budget.
+	// Default of CleanWindow is 30 minutes, set it to be negative to disable it.
 	CleanWindow time.Duration
+	// SweepWindow is the period used to remove outdated entry, the entries are removed in the order of
+	// their expiration, so only the entries due are visited.
+	// Default of SweepWindow is 1 second, set it to be negative to disable it.
+	SweepWindow time.Duration
+	// CleanBudget is the max number of outdated entries visited in every shard per SweepWindow, the others
+	// are removed by the next SweepWindow.
+	// Default of CleanBudget is 1024.
+	CleanBudget int
+	// CompactionWindow is the period used to compact the dead space of shard, which is left by the entries
+	// deleted, overwritten or outdated until they reach the head of queue.
+	// Default of CompactionWindow is 1 second.
+	CompactionWindow time.Duration
+	// CompactionBudget is the max bytes of every shard visited by one compaction.
+	// Default of CompactionBudget is 64KB.
+	CompactionBudget int
+	// ShrinkPeriod is the period after which the shard is shrunk if its live entries stay less than a quarter
+	// of its capacity, so the memory allocated for the spike of traffic is released. See TipTop.Shrink.
+	// Default of ShrinkPeriod is 10 minutes, set it to be negative to disable the automatic shrink.
+	ShrinkPeriod time.Duration
 	// Expiration Time of the entry which is not assign.
 	// DefaultTTL is set to 0 mean that entry never out of date.
 	DefaultTTL time.Duration
+	// SlidingExpiration makes the entries set by Set and SetWithTTL expire once they are not read for their ttl,
+	// rather than the ttl after they are set. See TipTop.SetWithIdle.
+	SlidingExpiration bool
+	// Loader is the default Loader of GetOrLoad, which is used when the loader is not given.
+	Loader Loader
+	// LoadTTL is the expiration time of the entry loaded by GetOrLoad.
+	// Default of LoadTTL is DefaultTTL.
+	LoadTTL time.Duration
+	// MissingTTL is the expiration time of the negative entry saved by SetMissing without ttl,
+	// or by GetOrLoad when the loader returns ErrKeyMissing.
+	// Default of MissingTTL is 1 minute.
+	MissingTTL time.Duration
+	// StaleWhileRevalidate is the period after the expiration of the entry, in which the stale value is still
+	// returned by Get while it is refreshed in background by Loader once. The entry is removed when the period
+	// passes. The value refreshed is saved with the ttl of the stale entry. It requires Loader.
+	// Default value is set to 0 which mean the entry is removed as soon as it is out of date.
+	StaleWhileRevalidate time.Duration
 	// tiptop use in-memory to caching acquiescently. When the Redis is on,
 	// if the number of marker exceed the MaxEntrySize, the oldest entry will be remove to
 	// Redis. if want to use Redis as secondary cache, set RedisAddr to be "addr:port"
-	// The address required for connecting to Redis
+	// The address required for connecting to Redis.
+	// Every TipTop connects to Redis by its own client which is shared by its shards.
 	RedisAddr string
 	// The password required for connecting to Redis
 	// When RedisPwd is "" mean that Redis Client doesn't need password.
@@ -39,6 +103,62 @@ type Config struct {
 	RedisMinIdle int
 	//RedisPoolSize, the pool size of the redis connection
 	RedisPoolSize int
+	// KeyPrefix is the prefix of the records stored in Redis, the services sharing one Redis
+	// should use the different prefixes, Reset only removes the records with the prefix.
+	// Default of KeyPrefix is "tiptop::key::".
+	KeyPrefix string
+	// When RedisStoreKey is true, the entry is stored in Redis under KeyPrefix plus the key itself
+	// instead of the sum64 of the key, so the keys collided on sum64 don't overwrite each other
+	// and the application key of the record can be told.
+	RedisStoreKey bool
+	// InvalidationChannel is the channel of Redis used to keep the TipTop sharing one Redis consistent.
+	// When it is set, every Set and Delete publishes the key on the channel, and the other TipTop subscribing
+	// the channel drop the entry of the key from their in-memory. It only works with Redis and WriteThrough,
+	// since the other TipTop would read the former value from Redis if the value published isn't written to Redis
+	// yet by WriteBehind, or never by WriteEvictOnly.
+	InvalidationChannel string
+	// DiskPath is the directory used to store the entries removed from in-memory when Redis can't be used,
+	// set DiskPath to be a local directory to use the disk as secondary cache, see NewDiskStore.
+	// When RedisAddr is set, DiskPath is ignored.
+	DiskPath string
+	// DiskSegmentSize is the size of every segment file in DiskPath.
+	// Default of DiskSegmentSize is 64MB.
+	DiskSegmentSize int
+	// DiskMaxSize is the max size of all files in DiskPath. if it is achieved, the oldest
+	// segment file will be removed with its entries.
+	// Default value is set to 0 which mean unlimited size.
+	DiskMaxSize int
+	// WriteMode decides when the entries are written to the secondary cache, the secondary cache is used
+	// even though OnRemove is false if it is not WriteEvictOnly.
+	// Default of WriteMode is WriteEvictOnly.
+	WriteMode WriteMode
+	// WriteBehindInterval is the period used to write the entries queued by WriteBehind, the queue is
+	// configured as same as the asynchronous demotion.
+	// Default of WriteBehindInterval is 1 second.
+	WriteBehindInterval time.Duration
+	// When AsyncDemotion is true, the entries removed from in-memory are queued and written to
+	// the secondary cache by a background writer in batches, instead of being written under the lock of shard.
+	AsyncDemotion bool
+	// DemotionQueueSize is the max number of entries waiting to be written by the asynchronous demotion.
+	// Default of DemotionQueueSize is 4096.
+	DemotionQueueSize int
+	// DemotionBatchSize is the max number of entries written at once by the asynchronous demotion.
+	// Default of DemotionBatchSize is 64.
+	DemotionBatchSize int
+	// DemotionPolicy decides what to do when the queue of the asynchronous demotion is full.
+	// Default of DemotionPolicy is DemotionBlock.
+	DemotionPolicy DemotionPolicy
+	// SecondaryStore is the secondary cache used instead of Redis, see SecondaryStore.
+	// When it is not nil, RedisAddr and the other Redis options are ignored.
+	// The store is not closed by TipTop.Close, so it can be shared by several TipTop.
+	SecondaryStore SecondaryStore
+	// OnEvict is called with the key, value and the reason when an entry is removed from in-memory, which is
+	// called outside the lock of shard, so it can call TipTop. The value of the negative entry is empty.
+	// The entry overwritten by the same key is not notified.
+	OnEvict func(key string, value []byte, reason RemoveReason)
+	// Clock provides the current time to the expiration of entries, which can be replaced by the tests.
+	// Default of Clock is the system time.
+	Clock Clock
 	// When the OnRemove is true, if the number of marker exceed the MaxEntrySize,
 	// the oldest entry will be remove.
 	OnRemove bool
@@ -60,12 +180,69 @@ func implementConfig(config *Config) error {
 	if config.CleanWindow == 0 {
 		config.CleanWindow = DefaultCleanWindows
 	}
+	if config.Clock == nil {
+		config.Clock = systemClock{}
+	}
+	if config.SweepWindow == 0 {
+		config.SweepWindow = DefaultSweepWindow
+	}
+	if config.CleanBudget == 0 {
+		config.CleanBudget = DefaultCleanBudget
+	}
+	if config.CompactionWindow == 0 {
+		config.CompactionWindow = DefaultCompactionWindow
+	}
+	if config.CompactionBudget == 0 {
+		config.CompactionBudget = DefaultCompactionBudget
+	}
+	if config.ShrinkPeriod == 0 {
+		config.ShrinkPeriod = DefaultShrinkPeriod
+	}
 	if config.ShardSize == 0 {
 		config.ShardSize = DefaultShardSize
 	}
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = DefaultKeyPrefix
+	}
+	if config.LoadTTL == 0 {
+		config.LoadTTL = config.DefaultTTL
+	}
+	if config.Admission && (config.MaxCacheSize == 0 || !config.OnRemove) {
+		return errors.New("admission requires max cache size and on remove")
+	}
+	if config.Admission && config.admissionWindowSize() == 0 {
+		return errors.New("max cache size of shard is too small for the window of admission")
+	}
+	if config.MemoryBudget > 0 && !config.OnRemove {
+		return errors.New("memory budget requires on remove")
+	}
+	if config.MissingTTL == 0 {
+		config.MissingTTL = DefaultMissingTTL
+	}
+	if config.StaleWhileRevalidate > 0 && config.Loader == nil {
+		return errors.New("stale-while-revalidate requires loader")
+	}
+	if config.InvalidationChannel != "" && config.WriteMode != WriteThrough {
+		return errors.New("invalidation channel requires write-through")
+	}
+	if config.WriteMode == WriteBehind && config.WriteBehindInterval == 0 {
+		config.WriteBehindInterval = DefaultWriteBehindInterval
+	}
 	return nil
 }
 
+// maximumShardEntries computes maximum number of entries of shard, which is at least 1 if MaxEntries is set.
+func (c Config) maximumShardEntries() int {
+	if c.MaxEntries <= 0 {
+		return 0
+	}
+	maxShardEntries := c.MaxEntries / c.ShardSize
+	if maxShardEntries == 0 {
+		maxShardEntries = 1
+	}
+	return maxShardEntries
+}
+
 // maximumShardSize computes maximum shard size
 func (c Config) maximumShardSize() int {
 	maxShardSize := 0
@@ -76,3 +253,8 @@ func (c Config) maximumShardSize() int {
 
 	return maxShardSize
 }
+
+// admissionWindowSize computes the size of the window of shard used by Admission
+func (c Config) admissionWindowSize() int {
+	return int(float64(c.maximumShardSize()) * admissionWindowRatio)
+}
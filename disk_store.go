@@ -0,0 +1,576 @@
+package tiptop
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDiskSegmentSize = 64 * MB
+
+	// the extension of segment file
+	diskSegmentExt = ".seg"
+	// Number of bytes used for size of entry of record
+	diskEntrySizeInBytes = 4
+	// Number of bytes used for flags of record
+	diskFlagsSizeInBytes = 1
+	// Number of bytes used for all headers of record, which are crc32, expiration,
+	// size of key, size of entry and flags.
+	diskHeadersSizeInBytes = crc32SizeInBytes + timestampSizeInBytes + keySizeInBytes + diskEntrySizeInBytes + diskFlagsSizeInBytes
+	// the flag of record means that the key has been deleted
+	diskFlagDeleted = 1
+	// the segment is rewritten by compaction when the reclaimable bytes exceed the ratio of it.
+	diskCompactRatio = 0.5
+)
+
+var (
+	errDiskNotFound  = errors.New("key is not found in disk")
+	errDiskOutdated  = errors.New("key is outdated in disk")
+	errDiskCorrupted = errors.New("record is corrupted in disk")
+)
+
+// diskStore is the SecondaryStore keeping the entries in the append-only segment files of a local directory.
+// The records of all keys are appended to the last segment, the index in memory points to the latest record
+// of every key, so the records overwritten, deleted or outdated are dead and will be reclaimed by compaction
+// which rewrites the live records of the segment to the last one. The compaction runs in background once
+// a segment is full, and only takes the lock to move a record, so the writes don't wait for a whole segment.
+// When the size of all segments would exceed maxSize, the oldest segment will be dropped with its entries first.
+type diskStore struct {
+	lock        sync.RWMutex
+	path        string
+	segmentSize int64
+	maxSize     int64
+	clock       Clock
+	// segments is ordered from the oldest, the records are appended to the last one.
+	segments []*diskSegment
+	index    map[string]diskRecord
+	size     int64
+	buffer   []byte
+
+	// compaction wakes the background compaction, and compacting serializes the compactions.
+	compaction chan struct{}
+	compacting sync.Mutex
+	closing    sync.Once
+	closed     chan struct{}
+	done       chan struct{}
+}
+
+// diskSegment is a file of diskStore.
+type diskSegment struct {
+	id   int
+	file *os.File
+	size int64
+	// dead is the bytes of records which are overwritten or deleted.
+	dead int64
+}
+
+// diskRecord is the position of the latest record of a key.
+type diskRecord struct {
+	segment    *diskSegment
+	offset     int64
+	size       int64
+	expiration int64
+}
+
+// NewDiskStore returns a SecondaryStore which keeps the entries in the files of the directory path,
+// the entries are recovered from the files if they exist.
+// The segmentSize is the size of every file, DefaultDiskSegmentSize is used if it is 0.
+// The maxSize is the max size of all files, 0 means unlimited.
+func NewDiskStore(path string, segmentSize, maxSize int) (SecondaryStore, error) {
+	return newDiskStore(path, segmentSize, maxSize, systemClock{})
+}
+
+// newDiskStore returns the diskStore whose records expire by the clock.
+func newDiskStore(path string, segmentSize, maxSize int, clock Clock) (*diskStore, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultDiskSegmentSize
+	}
+	// keep several segments under the max size, so dropping the oldest one doesn't lose too much.
+	if maxSize > 0 && segmentSize > maxSize/4 {
+		segmentSize = maxSize / 4
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	d := &diskStore{
+		path:        path,
+		segmentSize: int64(segmentSize),
+		maxSize:     int64(maxSize),
+		clock:       clock,
+		index:       make(map[string]diskRecord),
+		compaction:  make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if err := d.recover(); err != nil {
+		_ = d.closeSegments()
+		return nil, err
+	}
+	if len(d.segments) == 0 {
+		if err := d.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	go d.run()
+	return d, nil
+}
+
+// run compacts the segments in background every time it is woken, until the store is closed.
+func (d *diskStore) run() {
+	defer close(d.done)
+	for {
+		select {
+		case <-d.compaction:
+			_ = d.compact()
+		case <-d.closed:
+			return
+		}
+	}
+}
+
+// recover loads the index from the segment files of the directory.
+func (d *diskStore) recover() error {
+	files, err := ioutil.ReadDir(d.path)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), diskSegmentExt) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(f.Name(), diskSegmentExt))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		file, err := os.OpenFile(d.segmentName(id), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		segment := &diskSegment{id: id, file: file}
+		d.segments = append(d.segments, segment)
+		if err := d.load(segment); err != nil {
+			return err
+		}
+		d.size += segment.size
+	}
+	return nil
+}
+
+// load reads all records of the segment to the index, the incomplete record at the end is truncated.
+func (d *diskStore) load(segment *diskSegment) error {
+	info, err := segment.file.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+	header := make([]byte, diskHeadersSizeInBytes)
+	for segment.size < end {
+		if _, err := segment.file.ReadAt(header, segment.size); err != nil {
+			break
+		}
+		size := int64(diskHeadersSizeInBytes + readDiskKeySize(header) + readDiskEntrySize(header))
+		if segment.size+size > end {
+			break
+		}
+		record := make([]byte, size)
+		if _, err := segment.file.ReadAt(record, segment.size); err != nil {
+			return err
+		}
+		if !validDiskRecord(record) {
+			break
+		}
+		d.apply(readDiskKey(record), diskRecord{
+			segment:    segment,
+			offset:     segment.size,
+			size:       size,
+			expiration: readDiskExpiration(record),
+		}, record[diskHeadersSizeInBytes-1]&diskFlagDeleted != 0)
+		segment.size += size
+	}
+	if segment.size < end {
+		return segment.file.Truncate(segment.size)
+	}
+	return nil
+}
+
+// apply updates the index with the record, the previous record of the key is dead.
+func (d *diskStore) apply(key string, record diskRecord, deleted bool) {
+	if previous, ok := d.index[key]; ok {
+		previous.segment.dead += previous.size
+	}
+	if deleted {
+		delete(d.index, key)
+		record.segment.dead += record.size
+		return
+	}
+	d.index[key] = record
+}
+
+func (d *diskStore) Get(key string, hash uint64) ([]byte, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	record, ok := d.index[key]
+	if !ok {
+		return nil, errDiskNotFound
+	}
+	if record.expiration != 0 && d.clock.Now().UnixNano() > record.expiration {
+		return nil, errDiskOutdated
+	}
+	data := make([]byte, record.size)
+	if _, err := record.segment.file.ReadAt(data, record.offset); err != nil {
+		return nil, err
+	}
+	if !validDiskRecord(data) || readDiskKey(data) != key {
+		return nil, errDiskCorrupted
+	}
+	return data[diskHeadersSizeInBytes+readDiskKeySize(data):], nil
+}
+
+func (d *diskStore) Set(key string, hash uint64, entry []byte, expiration time.Duration) error {
+	var timestamp int64
+	if expiration > 0 {
+		timestamp = d.clock.Now().Add(expiration).UnixNano()
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.append(key, entry, timestamp, false)
+}
+
+// SetBatch stores the entries under the lock once.
+func (d *diskStore) SetBatch(entries []StoreEntry) error {
+	now := d.clock.Now()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, e := range entries {
+		var timestamp int64
+		if e.Expiration > 0 {
+			timestamp = now.Add(e.Expiration).UnixNano()
+		}
+		if err := d.append(e.Key, e.Entry, timestamp, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *diskStore) Delete(key string, hash uint64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.index[key]; !ok {
+		return nil
+	}
+	return d.append(key, nil, 0, true)
+}
+
+func (d *diskStore) Exists(key string, hash uint64) (bool, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	record, ok := d.index[key]
+	return ok && (record.expiration == 0 || d.clock.Now().UnixNano() <= record.expiration), nil
+}
+
+// Reset removes all segment files.
+func (d *diskStore) Reset() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, segment := range d.segments {
+		_ = segment.file.Close()
+		if err := os.Remove(segment.file.Name()); err != nil {
+			return err
+		}
+	}
+	d.segments = nil
+	d.index = make(map[string]diskRecord)
+	d.size = 0
+	return d.rotate()
+}
+
+// Close stops the background compaction and closes the segment files.
+func (d *diskStore) Close() error {
+	d.closing.Do(func() { close(d.closed) })
+	<-d.done
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.closeSegments()
+}
+
+func (d *diskStore) closeSegments() error {
+	var err error
+	for _, segment := range d.segments {
+		if e := segment.file.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// append writes the record to the last segment and updates the index. It must be called with the lock held.
+func (d *diskStore) append(key string, entry []byte, expiration int64, deleted bool) error {
+	data := d.wrap(key, entry, expiration, deleted)
+	segment, offset, err := d.write(data)
+	if segment == nil {
+		return err
+	}
+	d.apply(key, diskRecord{
+		segment:    segment,
+		offset:     offset,
+		size:       int64(len(data)),
+		expiration: expiration,
+	}, deleted)
+	return err
+}
+
+// write appends the record to the last segment, and returns the segment and the offset it is written at.
+// The oldest segments are dropped before if the record would exceed maxSize, and the segment is rotated
+// once it is full, which wakes the background compaction. It must be called with the lock held.
+func (d *diskStore) write(record []byte) (*diskSegment, int64, error) {
+	for d.maxSize > 0 && d.size+int64(len(record)) > d.maxSize && len(d.segments) > 1 {
+		if err := d.drop(); err != nil {
+			return nil, 0, err
+		}
+	}
+	segment := d.segments[len(d.segments)-1]
+	offset := segment.size
+	if _, err := segment.file.WriteAt(record, offset); err != nil {
+		return nil, 0, err
+	}
+	segment.size += int64(len(record))
+	d.size += int64(len(record))
+
+	if segment.size < d.segmentSize {
+		return segment, offset, nil
+	}
+	if err := d.rotate(); err != nil {
+		return segment, offset, err
+	}
+	select {
+	case d.compaction <- struct{}{}:
+	default:
+	}
+	return segment, offset, nil
+}
+
+// rotate creates a new segment to be written.
+func (d *diskStore) rotate() error {
+	id := 0
+	if len(d.segments) > 0 {
+		id = d.segments[len(d.segments)-1].id + 1
+	}
+	file, err := os.OpenFile(d.segmentName(id), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	d.segments = append(d.segments, &diskSegment{id: id, file: file})
+	return nil
+}
+
+// compact rewrites the live records of the segments whose dead or outdated records exceed
+// diskCompactRatio to the last segment, and removes these segments.
+func (d *diskStore) compact() error {
+	d.compacting.Lock()
+	defer d.compacting.Unlock()
+
+	d.lock.RLock()
+	now := d.clock.Now().UnixNano()
+	reclaimable := make(map[*diskSegment]int64, len(d.segments))
+	for _, segment := range d.segments {
+		reclaimable[segment] = segment.dead
+	}
+	for _, record := range d.index {
+		if record.expiration != 0 && now > record.expiration {
+			reclaimable[record.segment] += record.size
+		}
+	}
+
+	// the last segment is being written, so it is never compacted.
+	var compacted []*diskSegment
+	for _, segment := range d.segments[:len(d.segments)-1] {
+		if segment.size == 0 || float64(reclaimable[segment]) < diskCompactRatio*float64(segment.size) {
+			continue
+		}
+		compacted = append(compacted, segment)
+	}
+	d.lock.RUnlock()
+
+	for _, segment := range compacted {
+		if err := d.rewrite(segment, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrite moves the live records of the segment to the last segment and removes the segment. The segment is
+// read without the lock, since it is never written again, and the lock is only taken to move every record.
+// The segment may be dropped or reset meanwhile, whose file is closed, then the rewrite stops.
+func (d *diskStore) rewrite(segment *diskSegment, now int64) error {
+	d.lock.RLock()
+	oldest := d.segments[0] == segment
+	size := segment.size
+	d.lock.RUnlock()
+
+	var offset int64
+	header := make([]byte, diskHeadersSizeInBytes)
+	for offset < size {
+		if _, err := segment.file.ReadAt(header, offset); err != nil {
+			return err
+		}
+		n := int64(diskHeadersSizeInBytes + readDiskKeySize(header) + readDiskEntrySize(header))
+		record := make([]byte, n)
+		if _, err := segment.file.ReadAt(record, offset); err != nil {
+			return err
+		}
+		d.lock.Lock()
+		err := d.move(segment, offset, record, oldest, now)
+		d.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.remove(segment)
+}
+
+// move writes the record read at the offset of the segment to the last segment if it is still needed.
+// It must be called with the lock held.
+func (d *diskStore) move(segment *diskSegment, offset int64, record []byte, oldest bool, now int64) error {
+	size := int64(len(record))
+	key := readDiskKey(record)
+	current, live := d.index[key]
+
+	if record[diskHeadersSizeInBytes-1]&diskFlagDeleted != 0 {
+		// the deletion must be kept while the older segments may contain the record of the key.
+		if live || oldest {
+			return nil
+		}
+		last, _, err := d.write(record)
+		if last != nil {
+			last.dead += size
+		}
+		return err
+	}
+	if !live || current.segment != segment || current.offset != offset {
+		return nil
+	}
+	if current.expiration != 0 && now > current.expiration {
+		delete(d.index, key)
+		// the older segments may contain the record of the key, which must not be recovered.
+		if oldest {
+			return nil
+		}
+		deletion := d.wrap(key, nil, 0, true)
+		last, _, err := d.write(deletion)
+		if last != nil {
+			last.dead += int64(len(deletion))
+		}
+		return err
+	}
+	last, lastOffset, err := d.write(record)
+	if last != nil {
+		current.segment, current.offset = last, lastOffset
+		d.index[key] = current
+	}
+	return err
+}
+
+// drop removes the oldest segment with all of its entries.
+func (d *diskStore) drop() error {
+	oldest := d.segments[0]
+	for key, record := range d.index {
+		if record.segment == oldest {
+			delete(d.index, key)
+		}
+	}
+	return d.remove(oldest)
+}
+
+// remove closes and deletes the file of segment, unless it has been removed.
+func (d *diskStore) remove(segment *diskSegment) error {
+	found := false
+	for i, s := range d.segments {
+		if s == segment {
+			d.segments = append(d.segments[:i], d.segments[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+	d.size -= segment.size
+	_ = segment.file.Close()
+	return os.Remove(segment.file.Name())
+}
+
+func (d *diskStore) segmentName(id int) string {
+	return filepath.Join(d.path, fmt.Sprintf("%09d%s", id, diskSegmentExt))
+}
+
+// wrap packs the record with crc32 of the record, expiration, the key and the entry.
+func (d *diskStore) wrap(key string, entry []byte, expiration int64, deleted bool) []byte {
+	size := diskHeadersSizeInBytes + len(key) + len(entry)
+	if size > len(d.buffer) {
+		d.buffer = make([]byte, size)
+	}
+	blob := d.buffer[:size]
+
+	binary.LittleEndian.PutUint64(blob[crc32SizeInBytes:], uint64(expiration))
+	binary.LittleEndian.PutUint16(blob[crc32SizeInBytes+timestampSizeInBytes:], uint16(len(key)))
+	binary.LittleEndian.PutUint32(blob[crc32SizeInBytes+timestampSizeInBytes+keySizeInBytes:], uint32(len(entry)))
+	blob[diskHeadersSizeInBytes-1] = 0
+	if deleted {
+		blob[diskHeadersSizeInBytes-1] = diskFlagDeleted
+	}
+	copy(blob[diskHeadersSizeInBytes:], key)
+	copy(blob[diskHeadersSizeInBytes+len(key):], entry)
+	binary.LittleEndian.PutUint32(blob, crc32.ChecksumIEEE(blob[crc32SizeInBytes:]))
+
+	return blob
+}
+
+func validDiskRecord(data []byte) bool {
+	return binary.LittleEndian.Uint32(data) == crc32.ChecksumIEEE(data[crc32SizeInBytes:])
+}
+
+func readDiskExpiration(data []byte) int64 {
+	return int64(binary.LittleEndian.Uint64(data[crc32SizeInBytes:]))
+}
+
+func readDiskKeySize(data []byte) int {
+	return int(binary.LittleEndian.Uint16(data[crc32SizeInBytes+timestampSizeInBytes:]))
+}
+
+func readDiskEntrySize(data []byte) int {
+	return int(binary.LittleEndian.Uint32(data[crc32SizeInBytes+timestampSizeInBytes+keySizeInBytes:]))
+}
+
+func readDiskKey(data []byte) string {
+	return string(data[diskHeadersSizeInBytes : diskHeadersSizeInBytes+readDiskKeySize(data)])
+}
@@ -0,0 +1,293 @@
+package tiptop
+
+import (
+	"bytes"
+	"fmt"
+	"guriytan.cn/tiptop/clocktest"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tiptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func TestDiskStore_SetGetDelete(t *testing.T) {
+	store, err := newDiskStore(tempDir(t), 0, 0, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.Set("key", 1, []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get("key", 1)
+	if err != nil || string(got) != "value" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if ok, _ := store.Exists("key", 1); !ok {
+		t.Fatal("expected the key exists")
+	}
+
+	if err := store.Delete("key", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("key", 1); err != errDiskNotFound {
+		t.Fatalf("expected errDiskNotFound, got %v", err)
+	}
+}
+
+func TestDiskStore_Expiration(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	store, err := newDiskStore(tempDir(t), 0, 0, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	_ = store.Set("key", 1, []byte("value"), time.Second)
+	if _, err := store.Get("key", 1); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second + time.Nanosecond)
+	if _, err := store.Get("key", 1); err != errDiskOutdated {
+		t.Fatalf("expected errDiskOutdated, got %v", err)
+	}
+	if ok, _ := store.Exists("key", 1); ok {
+		t.Fatal("expected the outdated key doesn't exist")
+	}
+}
+
+func TestDiskStore_Recover(t *testing.T) {
+	dir := tempDir(t)
+	store, err := newDiskStore(dir, KB, 0, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 50; i++ {
+		_ = store.Set(fmt.Sprintf("key-%d", i), 0, value, 0)
+	}
+	_ = store.Delete("key-0", 0)
+	_ = store.Set("key-1", 0, []byte("new"), 0)
+	_ = store.Close()
+
+	// an incomplete record is left at the end of file
+	last := store.segments[len(store.segments)-1]
+	f, _ := os.OpenFile(last.file.Name(), os.O_WRONLY|os.O_APPEND, 0644)
+	_, _ = f.Write([]byte{1, 2, 3})
+	_ = f.Close()
+
+	store, err = newDiskStore(dir, KB, 0, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if _, err := store.Get("key-0", 0); err != errDiskNotFound {
+		t.Fatalf("expected errDiskNotFound, got %v", err)
+	}
+	if got, _ := store.Get("key-1", 0); string(got) != "new" {
+		t.Fatalf("unexpected %q", got)
+	}
+	for i := 2; i < 50; i++ {
+		if got, err := store.Get(fmt.Sprintf("key-%d", i), 0); err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("unexpected key-%d %q, %v", i, got, err)
+		}
+	}
+	_ = store.Set("key-50", 0, value, 0)
+	if got, err := store.Get("key-50", 0); err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+}
+
+func TestDiskStore_Compact(t *testing.T) {
+	store, err := newDiskStore(tempDir(t), KB, 0, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 1000; i++ {
+		_ = store.Set(fmt.Sprintf("key-%d", i%5), 0, value, 0)
+	}
+	// the overwritten records are reclaimed, only a few segments are left once the compaction is done
+	if err := store.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if store.size > 4*KB {
+		t.Fatalf("expected the dead records are reclaimed, size is %d", store.size)
+	}
+	for i := 0; i < 5; i++ {
+		if got, err := store.Get(fmt.Sprintf("key-%d", i), 0); err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("unexpected key-%d %q, %v", i, got, err)
+		}
+	}
+}
+
+func TestDiskStore_MaxSize(t *testing.T) {
+	store, err := newDiskStore(tempDir(t), KB, 4*KB, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 100; i++ {
+		_ = store.Set(fmt.Sprintf("key-%d", i), 0, value, 0)
+	}
+	if store.size > 4*KB {
+		t.Fatalf("expected size under 4KB, got %d", store.size)
+	}
+	// the oldest entries are dropped and the newest are kept
+	if _, err := store.Get("key-0", 0); err != errDiskNotFound {
+		t.Fatalf("expected errDiskNotFound, got %v", err)
+	}
+	if got, err := store.Get("key-99", 0); err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+}
+
+func TestDiskStore_MaxSizeBeforeAppend(t *testing.T) {
+	store, err := newDiskStore(tempDir(t), KB, 4*KB, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// the limit is kept after every set, without waiting for the compaction
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 100; i++ {
+		_ = store.Set(fmt.Sprintf("key-%d", i), 0, value, 0)
+		store.lock.RLock()
+		size := store.size
+		store.lock.RUnlock()
+		if size > 4*KB {
+			t.Fatalf("expected size under 4KB after key-%d, got %d", i, size)
+		}
+	}
+}
+
+func TestTipTop_DiskPath(t *testing.T) {
+	dir := tempDir(t)
+	tip, err := NewTipTop(Config{
+		ShardSize:    1,
+		MaxCacheSize: KB,
+		DiskPath:     dir,
+		OnRemove:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 20; i++ {
+		_ = tip.Set(fmt.Sprintf("key-%d", i), value)
+	}
+	for i := 0; i < 20; i++ {
+		if got, err := tip.Get(fmt.Sprintf("key-%d", i)); err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("unexpected key-%d %q, %v", i, got, err)
+		}
+	}
+	if stats := tip.GetStats(); stats.HitsRedis == 0 {
+		t.Fatalf("expected entries read from disk, stats %+v", stats)
+	}
+}
+
+func TestDiskStore_CompactAdjacent(t *testing.T) {
+	dir := tempDir(t)
+	store, err := newDiskStore(dir, KB, 0, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("v"), 100)
+	var keys []string
+	for i := 0; store.segments[len(store.segments)-1].id < 2; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_ = store.Set(key, 0, value, 0)
+		keys = append(keys, key)
+	}
+	// the first two segments are dead together, and compacted in one pass once the third one is full
+	for _, key := range keys {
+		_ = store.Delete(key, 0)
+	}
+	for i := 0; store.segments[len(store.segments)-1].id < 3; i++ {
+		_ = store.Set(fmt.Sprintf("live-%d", i), 0, value, 0)
+	}
+	if err := store.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.segments) != 2 || store.segments[0].id != 2 || store.segments[1].id != 3 {
+		t.Fatalf("expected the segments 0 and 1 are compacted, got %d segments", len(store.segments))
+	}
+	if err := store.Set("key", 0, value, 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	store, err = newDiskStore(dir, KB, 0, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, key := range keys {
+		if _, err := store.Get(key, 0); err != errDiskNotFound {
+			t.Fatalf("expected errDiskNotFound, got %v", err)
+		}
+	}
+	if got, err := store.Get("key", 0); err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+}
+
+func TestDiskStore_CompactExpired(t *testing.T) {
+	dir := tempDir(t)
+	store, err := newDiskStore(dir, KB, 0, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("v"), 100)
+	_ = store.Set("key", 0, value, 0)
+	for i := 0; store.segments[len(store.segments)-1].id < 1; i++ {
+		_ = store.Set(fmt.Sprintf("live-%d", i), 0, value, 0)
+	}
+	// the key is overwritten by the record already outdated, the segment of which is compacted
+	store.lock.Lock()
+	_ = store.append("key", value, 1, false)
+	for i := 0; store.segments[len(store.segments)-1].id < 2; i++ {
+		_ = store.append(fmt.Sprintf("expired-%d", i), value, 1, false)
+	}
+	store.lock.Unlock()
+	if err := store.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if store.segments[0].id != 0 || store.segments[1].id != 2 {
+		t.Fatal("expected the segment 1 is compacted")
+	}
+	_ = store.Close()
+
+	// the record of the first segment is not recovered
+	store, err = newDiskStore(dir, KB, 0, systemClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := store.Get("key", 0); err != errDiskNotFound {
+		t.Fatalf("expected errDiskNotFound, got %v", err)
+	}
+	if got, err := store.Get("live-0", 0); err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+}
@@ -0,0 +1,165 @@
+package tiptop
+
+// EvictionPolicy decides which entry is removed from in-memory when the shard is full.
+type EvictionPolicy int
+
+const (
+	// EvictFIFO removes the entry set earliest, whether it is read or not.
+	EvictFIFO EvictionPolicy = iota
+	// EvictLRU removes the entry read or set earliest. The entry read in the older half of the queue
+	// is reinserted at the end of the queue, so the hot entries are kept while the entries in the newer half
+	// are read without the write lock.
+	EvictLRU
+	// EvictClock gives the entries read a second chance (CLOCK). The first read of an entry sets the visited bit
+	// in its header, and the oldest entry visited is requeued at the end with the bit cleared instead of being
+	// removed. It is close to LRU, but only the first read after the entry is pushed takes the write lock.
+	EvictClock
+)
+
+// RemoveReason is the reason why the entry is removed from in-memory, which is given to Config.OnEvict.
+type RemoveReason int
+
+const (
+	// Expired means the entry is out of date.
+	Expired RemoveReason = iota + 1
+	// NoSpace means the entry is removed to make room for the others, and it is not kept by the secondary cache.
+	NoSpace
+	// Deleted means the entry is deleted by Delete, or invalidated by the other TipTop.
+	Deleted
+	// Reset means the entry is removed by Reset.
+	Reset
+	// Demoted means the entry is removed to make room for the others, and written to the secondary cache.
+	Demoted
+	// Dropped means the entry is removed to make room for the others, and dropped by DemotionDropNewest
+	// since the queue of asynchronous demotion is full, or since the secondary cache fails to write it.
+	Dropped
+)
+
+// removal is the entry removed under the lock of shard, which is notified once the lock is released.
+type removal struct {
+	key    string
+	value  []byte
+	reason RemoveReason
+}
+
+// notify records the entry removed for the reason if OnEvict is set. It must be called with the lock held.
+func (s *shard) notify(entry []byte, reason RemoveReason) {
+	if s.onEvict == nil {
+		return
+	}
+	s.removals = append(s.removals, removal{
+		key:    readKeyFromEntry(entry),
+		value:  readEntry(entry),
+		reason: reason,
+	})
+}
+
+// unlock releases the lock, then calls OnEvict with the entries removed under the lock.
+func (s *shard) unlock() {
+	removals := s.removals
+	s.removals = nil
+	s.lock.Unlock()
+	for _, r := range removals {
+		s.onEvict(r.key, r.value, r.reason)
+	}
+}
+
+// shouldPromote reports whether the entry of index is old enough to be reinserted when it is read.
+// It must be called with the lock held.
+func (s *shard) shouldPromote(index int) bool {
+	return s.evictionPolicy == EvictLRU && index > 0 && s.entries.Offset(index) < s.entries.Size()/2
+}
+
+// promote reinserts the entry of the hash at the end of the queue, unless it has been changed since
+// it is read at index. The oldest entries are removed if the queue is full, as same as set.
+func (s *shard) promote(hash uint64, index int) {
+	s.lock.Lock()
+	defer s.unlock()
+
+	if s.marker[hash] != index {
+		return
+	}
+	wrappedEntry, err := s.entries.Get(index)
+	if err != nil {
+		return
+	}
+	// the entry is copied and reset before push, since the queue may be reallocated by push.
+	if len(wrappedEntry) > len(s.buffer) {
+		s.buffer = make([]byte, len(wrappedEntry))
+	}
+	w := s.buffer[:len(wrappedEntry)]
+	copy(w, wrappedEntry)
+	resetKeyFromEntry(wrappedEntry)
+
+	for {
+		if newIndex, err := s.entries.Push(w); err == nil {
+			s.marker[hash] = newIndex
+			s.statsPromotion()
+			return
+		}
+		if !s.onRemove {
+			// the entry is kept where it is.
+			copy(wrappedEntry, w[:headersSizeInBytes])
+			return
+		}
+		if s.removeOldest() != nil {
+			s.evict(hash, w)
+			return
+		}
+	}
+}
+
+// visit sets the visited bit of the entry of the hash, unless it has been changed since it is read at index.
+func (s *shard) visit(hash uint64, index int) {
+	s.lock.Lock()
+	defer s.unlock()
+
+	if s.marker[hash] != index {
+		return
+	}
+	if wrappedEntry, err := s.getEntry(index); err == nil {
+		writeFlagsToEntry(wrappedEntry, readFlagsFromEntry(wrappedEntry)|flagVisited)
+	}
+}
+
+// removeSecondChance removes the oldest entry not visited, the visited entries before it are requeued at the end
+// of the queue with the bit cleared. If there is no room to requeue an entry, the next oldest one is removed
+// whether it is visited or not. It must be called with the lock held.
+func (s *shard) removeSecondChance() error {
+	for chances := s.entries.Len(); ; chances-- {
+		oldest, err := s.entries.Peek()
+		if err != nil {
+			return err
+		}
+		hash := readHashFromEntry(oldest)
+		if hash == 0 || chances <= 0 || readFlagsFromEntry(oldest)&flagVisited == 0 {
+			return s.removeOldestEntry()
+		}
+
+		// the entry is copied since its space is reused by push.
+		if len(oldest) > len(s.requeueBuffer) {
+			s.requeueBuffer = make([]byte, len(oldest))
+		}
+		w := s.requeueBuffer[:len(oldest)]
+		copy(w, oldest)
+		writeFlagsToEntry(w, readFlagsFromEntry(w)&^flagVisited)
+		_, _ = s.entries.Pop()
+
+		removed := false
+		for {
+			if index, err := s.entries.Push(w); err == nil {
+				s.marker[hash] = index
+				break
+			}
+			if s.removeOldestEntry() != nil {
+				s.evict(hash, w)
+				return nil
+			}
+			removed = true
+		}
+		s.statsRequeue()
+		if removed {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package tiptop
+
+import (
+	"bytes"
+	"fmt"
+	"guriytan.cn/tiptop/clocktest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTipTop_EvictionPolicy(t *testing.T) {
+	value := bytes.Repeat([]byte("a"), 100)
+	for _, policy := range []EvictionPolicy{EvictFIFO, EvictLRU, EvictClock} {
+		tip, err := NewTipTop(Config{
+			ShardSize:      1,
+			MaxCacheSize:   4 * KB,
+			OnRemove:       true,
+			EvictionPolicy: policy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = tip.Set("hot", value)
+		hits := 0
+		for i := 0; i < 200; i++ {
+			if err := tip.Set(fmt.Sprintf("key-%d", i), value); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := tip.Get("hot"); err == nil && bytes.Equal(got, value) {
+				hits++
+			}
+		}
+
+		switch policy {
+		case EvictFIFO:
+			if hits == 200 {
+				t.Fatal("expected the hot key is evicted by FIFO")
+			}
+		case EvictLRU:
+			if hits != 200 {
+				t.Fatalf("expected the hot key is kept by LRU, got %d hits", hits)
+			}
+			if tip.GetStats().Promotions == 0 {
+				t.Fatal("expected the hot key is promoted")
+			}
+		case EvictClock:
+			if hits != 200 {
+				t.Fatalf("expected the hot key is kept by CLOCK, got %d hits", hits)
+			}
+			if tip.GetStats().Requeues == 0 {
+				t.Fatal("expected the hot key is requeued")
+			}
+		}
+		// the entries promoted are still readable
+		if got, err := tip.Get("key-199"); err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("unexpected %q, %v", got, err)
+		}
+		_ = tip.Close()
+	}
+}
+
+func TestTipTop_OnEvict(t *testing.T) {
+	type removal struct {
+		key    string
+		value  string
+		reason RemoveReason
+	}
+	var lock sync.Mutex
+	var removals []removal
+	var tip *TipTop
+	onEvict := func(key string, value []byte, reason RemoveReason) {
+		// it is called outside the lock of shard
+		_ = tip.Len()
+		lock.Lock()
+		removals = append(removals, removal{key, string(value), reason})
+		lock.Unlock()
+	}
+	expect := func(expected ...removal) {
+		t.Helper()
+		waitFor(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(removals) >= len(expected)
+		})
+		lock.Lock()
+		defer lock.Unlock()
+		if !reflect.DeepEqual(removals, expected) {
+			t.Fatalf("expected %v, got %v", expected, removals)
+		}
+		removals = nil
+	}
+
+	var err error
+	clock := clocktest.NewClock(time.Now())
+	tip, err = NewTipTop(Config{ShardSize: 1, MaxEntries: 2, OnRemove: true, OnEvict: onEvict, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	_ = tip.Set("a", []byte("1"))
+	_ = tip.Set("a", []byte("2"))
+	_ = tip.Set("b", []byte("3"))
+	_ = tip.Set("c", []byte("4"))
+	expect(removal{"a", "2", NoSpace})
+
+	_ = tip.Delete("b")
+	expect(removal{"b", "3", Deleted})
+
+	_ = tip.SetWithTTL("d", []byte("5"), time.Second)
+	clock.Advance(2 * time.Second)
+	if _, err := tip.Get("d"); err != errEntryIsDead {
+		t.Fatalf("expected errEntryIsDead, got %v", err)
+	}
+	expect(removal{"d", "5", Expired})
+
+	tip.Reset()
+	expect(removal{"c", "4", Reset})
+
+	store := newMemoryStore()
+	tip, err = NewTipTop(Config{ShardSize: 1, MaxEntries: 1, OnRemove: true, OnEvict: onEvict, SecondaryStore: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	_ = tip.Set("a", []byte("1"))
+	_ = tip.Set("b", []byte("2"))
+	expect(removal{"a", "1", Demoted})
+
+	// the entry failed to write to the secondary store is dropped rather than demoted
+	tip, err = NewTipTop(Config{
+		ShardSize:      1,
+		MaxEntries:     1,
+		OnRemove:       true,
+		OnEvict:        onEvict,
+		SecondaryStore: &failingStore{memoryStore: newMemoryStore()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	_ = tip.Set("fail", []byte("1"))
+	_ = tip.Set("b", []byte("2"))
+	expect(removal{"fail", "1", Dropped})
+	if stats := tip.GetStats(); stats.DemotionFailed != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// the entry dropped by the full queue of asynchronous demotion is not demoted
+	blocking := &blockingStore{memoryStore: newMemoryStore(), release: make(chan struct{})}
+	tip, err = NewTipTop(Config{
+		ShardSize:         1,
+		MaxEntries:        1,
+		OnRemove:          true,
+		OnEvict:           onEvict,
+		SecondaryStore:    blocking,
+		AsyncDemotion:     true,
+		DemotionQueueSize: 1,
+		DemotionBatchSize: 1,
+		DemotionPolicy:    DemotionDropNewest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = tip.Set("a", []byte("1"))
+	_ = tip.Set("b", []byte("2"))
+	// the writer is blocked with a, and b fills the queue
+	waitFor(t, func() bool { return len(tip.async.queue) == 0 })
+	_ = tip.Set("c", []byte("3"))
+	_ = tip.Set("d", []byte("4"))
+	expect(removal{"a", "1", Demoted}, removal{"b", "2", Demoted}, removal{"c", "3", Dropped})
+	close(blocking.release)
+	_ = tip.Close()
+	if stats := tip.GetStats(); stats.DemotionQueued != 2 || stats.DemotionDropped != 1 || stats.DemotionFlushed != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,237 @@
+package tiptop
+
+import (
+	"container/heap"
+	"hash/crc32"
+	"time"
+)
+
+const (
+	DefaultSweepWindow = time.Second
+	DefaultCleanBudget = 1024
+)
+
+// expiration is the time the entry of the hash is removed, which is out of date once it is set again.
+type expiration struct {
+	timestamp int64
+	hash      uint64
+}
+
+// expiryHeap orders the expirations of shard from the earliest, so the entries due are found without a scan.
+type expiryHeap []expiration
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].timestamp < h[j].timestamp }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(expiration))
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// schedule tracks the expiration of the entry pushed with the timestamp. The heap is rebuilt from the marker
+// when most of its expirations are out of date, since the entries are deleted or set again.
+// It must be called with the lock held.
+func (s *shard) schedule(hash uint64, timeStamp int64) {
+	if timeStamp == 0 {
+		return
+	}
+	if len(s.expiries) > 2*len(s.marker)+DefaultCleanBudget {
+		s.rebuildExpiries()
+	}
+	heap.Push(&s.expiries, expiration{timestamp: s.expiry(timeStamp), hash: hash})
+}
+
+// rebuildExpiries drops the expirations out of date. It must be called with the lock held.
+func (s *shard) rebuildExpiries() {
+	expiries := s.expiries[:0]
+	for hash, index := range s.marker {
+		wrappedEntry, err := s.getEntry(index)
+		if err != nil {
+			continue
+		}
+		if timeStamp := readTimestampFromEntry(wrappedEntry); timeStamp != 0 {
+			expiries = append(expiries, expiration{timestamp: s.expiry(timeStamp), hash: hash})
+		}
+	}
+	// the tail of the old heap is cleared for garbage collection.
+	for i := len(expiries); i < len(s.expiries); i++ {
+		s.expiries[i] = expiration{}
+	}
+	s.expiries = expiries
+	heap.Init(&s.expiries)
+}
+
+// removeExpired removes the entries due in the order of expiration, at most budget expirations are visited.
+// The entries of the keys demoted before are deleted from the secondary store by WriteEvictOnly.
+func (s *shard) removeExpired(budget int) {
+	s.lock.Lock()
+	var expired []StoreEntry
+	now := s.clock.epoch()
+	for i := 0; i < budget && len(s.expiries) > 0 && now > s.expiries[0].timestamp; i++ {
+		e := heap.Pop(&s.expiries).(expiration)
+		itemIndex := s.marker[e.hash]
+		if itemIndex == 0 {
+			continue
+		}
+		wrappedEntry, err := s.getEntry(itemIndex)
+		if err != nil || s.expiry(readTimestampFromEntry(wrappedEntry)) != e.timestamp {
+			// the entry has been set again with another expiration.
+			continue
+		}
+		if s.store != nil && s.writeMode == WriteEvictOnly {
+			expired = append(expired, StoreEntry{Key: readKeyFromEntry(wrappedEntry), Hash: e.hash})
+		}
+		delete(s.marker, e.hash)
+		resetKeyFromEntry(wrappedEntry)
+		s.release(wrappedEntry)
+		s.notify(wrappedEntry, Expired)
+		s.statsExpiredSweep()
+	}
+	s.unlock()
+
+	// the secondary store is visited outside the lock, so the sweep doesn't hold the shard for it.
+	for _, e := range expired {
+		_ = s.dropDemoted(e.Key, e.Hash)
+	}
+}
+
+// ttl returns the remaining time to live of the key, 0 if the key never expires.
+// If the key doesn't exist in in-memory, it is read from the secondary store.
+func (s *shard) ttl(key string, hash uint64) (time.Duration, error) {
+	s.lock.RLock()
+	wrappedEntry, err := s.getWrappedEntry(hash)
+	if err != nil {
+		s.lock.RUnlock()
+		if s.store != nil {
+			return s.ttlFromStore(key, hash)
+		}
+		return 0, errKeyNotFound
+	}
+	if readCRC32FromEntry(wrappedEntry) != crc32.ChecksumIEEE([]byte(key)) {
+		s.lock.RUnlock()
+		return 0, errKeyNotFound
+	}
+	timeStamp := readTimestampFromEntry(wrappedEntry)
+	s.lock.RUnlock()
+	return s.remaining(timeStamp)
+}
+
+func (s *shard) ttlFromStore(key string, hash uint64) (time.Duration, error) {
+	wrappedEntry, err := s.getStoredEntry(key, hash)
+	if err != nil {
+		return 0, err
+	}
+	return s.remaining(readTimestampFromEntry(wrappedEntry))
+}
+
+// remaining returns the time to live of the timestamp, errEntryIsDead is returned if it is out of date
+// even though it is still served by StaleWhileRevalidate.
+func (s *shard) remaining(timeStamp int64) (time.Duration, error) {
+	ttl, alive := s.clock.ttl(timeStamp)
+	if !alive {
+		return 0, errEntryIsDead
+	}
+	return ttl, nil
+}
+
+// expire rewrites the expiration of the key to ttl from now in place, 0 means never out of date. If touch is true,
+// the entry is renewed with its own ttl instead, see touched. The entry is rescheduled, and written to the secondary
+// store if it is kept there as well. If the key doesn't exist in in-memory, the entry of the secondary store is rewritten.
+func (s *shard) expire(key string, hash uint64, ttl time.Duration, touch bool) error {
+	s.lock.Lock()
+	wrappedEntry, err := s.getWrappedEntry(hash)
+	if err != nil {
+		s.unlock()
+		if s.store != nil {
+			return s.expireInStore(key, hash, ttl, touch)
+		}
+		return errKeyNotFound
+	}
+	if readCRC32FromEntry(wrappedEntry) != crc32.ChecksumIEEE([]byte(key)) {
+		s.unlock()
+		return errKeyNotFound
+	}
+	if s.expired(readTimestampFromEntry(wrappedEntry)) {
+		s.unlock()
+		return errEntryIsDead
+	}
+	if touch {
+		var renew bool
+		if ttl, renew, err = touched(wrappedEntry); !renew {
+			s.unlock()
+			return err
+		}
+	}
+
+	w, timeStamp := s.rewrite(hash, wrappedEntry, ttl)
+	s.unlock()
+	if w == nil {
+		return nil
+	}
+	return s.storeExpired(key, hash, w, timeStamp)
+}
+
+// touched returns the ttl the entry is renewed with by Touch, which is the ttl it is set with, or the idle period
+// of the sliding entry. False is returned if the entry never expires, whose expiration is left unchanged, or with
+// errTTLUnknown if the ttl isn't kept by the entry, such as the one written by the former version.
+func touched(wrappedEntry []byte) (time.Duration, bool, error) {
+	if readTimestampFromEntry(wrappedEntry) == 0 {
+		return 0, false, nil
+	}
+	period := readPeriodFromEntry(wrappedEntry)
+	if period == 0 {
+		return 0, false, errTTLUnknown
+	}
+	return time.Duration(period) * time.Millisecond, true, nil
+}
+
+// rewrite sets the expiration of the entry of the hash to ttl from now and reschedules it. The copy of the entry
+// is returned to be written to the secondary store if it is kept there as well, nil if not.
+// It must be called with the lock held.
+func (s *shard) rewrite(hash uint64, wrappedEntry []byte, ttl time.Duration) ([]byte, int64) {
+	timeStamp := s.clock.exp(ttl)
+	writeTimestampToEntry(wrappedEntry, timeStamp)
+	s.schedule(hash, timeStamp)
+	if s.writeMode == WriteEvictOnly {
+		return nil, timeStamp
+	}
+	return append([]byte(nil), wrappedEntry...), timeStamp
+}
+
+func (s *shard) expireInStore(key string, hash uint64, ttl time.Duration, touch bool) error {
+	wrappedEntry, err := s.getStoredEntry(key, hash)
+	if err != nil {
+		return err
+	}
+	if s.expired(readTimestampFromEntry(wrappedEntry)) {
+		return errEntryIsDead
+	}
+	if touch {
+		var renew bool
+		if ttl, renew, err = touched(wrappedEntry); !renew {
+			return err
+		}
+	}
+	// the entry may be shared by the store, such as the one pending to write.
+	w := append([]byte(nil), wrappedEntry...)
+	timeStamp := s.clock.exp(ttl)
+	writeTimestampToEntry(w, timeStamp)
+	return s.storeExpired(key, hash, w, timeStamp)
+}
+
+// storeExpired writes the entry with the new expiration to the secondary store, which keeps the stale entry
+// as long as in-memory. The entry already out of date is deleted.
+func (s *shard) storeExpired(key string, hash uint64, w []byte, timeStamp int64) error {
+	expiration, alive := s.clock.ttl(s.expiry(timeStamp))
+	if !alive {
+		return s.store.Delete(key, hash)
+	}
+	return s.store.Set(key, hash, w, expiration)
+}
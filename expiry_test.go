@@ -0,0 +1,282 @@
+package tiptop
+
+import (
+	"bytes"
+	"fmt"
+	"guriytan.cn/tiptop/clocktest"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+func TestTipTop_RemoveOutdated(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{ShardSize: 1, CleanBudget: 10, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	for i := 0; i < 30; i++ {
+		_ = tip.SetWithTTL(fmt.Sprintf("key-%d", i), []byte("v"), time.Duration(i%3+1)*time.Second)
+	}
+	_ = tip.Set("forever", []byte("v"))
+	// the expiration is extended by setting again
+	_ = tip.SetWithTTL("key-0", []byte("v"), time.Minute)
+
+	clock.Advance(2 * time.Second)
+	tip.removeOutdated()
+	if tip.Len() != 22 || tip.GetStats().ExpiredSweep != 9 {
+		t.Fatalf("expected the entries of 1s are removed, got %d entries, stats %+v", tip.Len(), tip.GetStats())
+	}
+
+	clock.Advance(2 * time.Second)
+	// at most CleanBudget of expirations are visited
+	tip.removeOutdated()
+	if tip.Len() != 12 {
+		t.Fatalf("expected 12 entries, got %d", tip.Len())
+	}
+	// the clean up removes all the entries due regardless of CleanBudget
+	tip.cleanUp()
+	if tip.Len() != 2 || tip.GetStats().ExpiredSweep != 29 {
+		t.Fatalf("expected 2 entries, got %d, stats %+v", tip.Len(), tip.GetStats())
+	}
+	for _, key := range []string{"key-0", "forever"} {
+		if _, err := tip.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := tip.Get("key-0"); err != errEntryIsDead {
+		t.Fatalf("expected errEntryIsDead, got %v", err)
+	}
+	if stats := tip.GetStats(); stats.ExpiredRead != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestTipTop_SubSecondTTL(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{ShardSize: 1, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	_ = tip.SetWithTTL("key", []byte("v"), 300*time.Millisecond)
+	clock.Advance(200 * time.Millisecond)
+	if _, err := tip.Get("key"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(150 * time.Millisecond)
+	tip.removeOutdated()
+	if tip.Len() != 0 {
+		t.Fatal("expected the entry is removed after 300ms")
+	}
+}
+
+func TestShard_RebuildExpiries(t *testing.T) {
+	tip, err := NewTipTop(Config{ShardSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	for i := 0; i < 10*DefaultCleanBudget; i++ {
+		_ = tip.SetWithTTL(fmt.Sprintf("key-%d", i%10), []byte("v"), time.Duration(i+1)*time.Second)
+	}
+	if n := len(tip.shards[0].expiries); n > 2*10+DefaultCleanBudget+1 {
+		t.Fatalf("expected the expirations out of date are dropped, got %d", n)
+	}
+}
+
+func TestTipTop_Expire(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{ShardSize: 1, DefaultTTL: time.Minute, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	_ = tip.SetWithTTL("key", []byte("v"), 10*time.Second)
+	_ = tip.SetWithTTL("forever", []byte("v"), 0)
+	if ttl, err := tip.TTL("key"); err != nil || ttl != 10*time.Second {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+	if ttl, err := tip.TTL("forever"); err != nil || ttl != 0 {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+	if _, err := tip.TTL("unknown"); err != errKeyNotFound {
+		t.Fatalf("expected errKeyNotFound, got %v", err)
+	}
+
+	// the expiration is extended in place, the former one is not swept
+	clock.Advance(5 * time.Second)
+	if err := tip.Expire("key", 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10 * time.Second)
+	tip.removeOutdated()
+	if ttl, err := tip.TTL("key"); err != nil || ttl != 10*time.Second {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+	if got, err := tip.Get("key"); err != nil || string(got) != "v" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+
+	if err := tip.Touch("key"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := tip.TTL("key"); ttl != 10*time.Second {
+		t.Fatalf("expected the ttl not kept by the entry is left unchanged, got %v", ttl)
+	}
+	if err := tip.Persist("key"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	tip.removeOutdated()
+	if ttl, err := tip.TTL("key"); err != nil || ttl != 0 {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+
+	// the expiration is shortened and the entry is swept
+	if err := tip.Expire("forever", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Second)
+	if _, err := tip.TTL("forever"); err != errEntryIsDead {
+		t.Fatalf("expected errEntryIsDead, got %v", err)
+	}
+	if err := tip.Expire("forever", time.Minute); err != errEntryIsDead {
+		t.Fatalf("expected errEntryIsDead, got %v", err)
+	}
+	tip.removeOutdated()
+	if tip.Len() != 1 {
+		t.Fatalf("expected 1 entry, got %d", tip.Len())
+	}
+}
+
+func TestTipTop_Touch(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	config := Config{ShardSize: 1, Clock: clock}
+	tip, err := NewTipTop(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	// the ttl the key is set with is renewed
+	_ = tip.SetWithTTL("key", []byte("v"), 10*time.Second)
+	clock.Advance(8 * time.Second)
+	if err := tip.Touch("key"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := tip.TTL("key"); err != nil || ttl != 10*time.Second {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+
+	// the ttl isn't kept by the entry of the former version, which is reported rather than renewed silently
+	hash := defaultHashCalculator().sum64("former")
+	tip.getShard(hash).lock.Lock()
+	_ = tip.getShard(hash).push(hash, wrapEntry(unixMilli(clock.Now().Add(time.Minute)), 0, 0, hash, crc32.ChecksumIEEE([]byte("former")), "former", []byte("v"), new([]byte)))
+	tip.getShard(hash).lock.Unlock()
+	if err := tip.Touch("former"); err != errTTLUnknown {
+		t.Fatalf("expected errTTLUnknown, got %v", err)
+	}
+	if ttl, err := tip.TTL("former"); err != nil || ttl != time.Minute {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+
+	// the ttl kept for StaleWhileRevalidate is renewed
+	config.StaleWhileRevalidate = time.Minute
+	config.Loader = func(key string) ([]byte, error) { return []byte("v"), nil }
+	tip, err = NewTipTop(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	_ = tip.SetWithTTL("key", []byte("v"), time.Minute)
+	_ = tip.SetWithTTL("forever", []byte("v"), 0)
+	clock.Advance(10 * time.Second)
+	if err := tip.Touch("key"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := tip.TTL("key"); err != nil || ttl != time.Minute {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+	if err := tip.Touch("forever"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := tip.TTL("forever"); err != nil || ttl != 0 {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+}
+
+func TestTipTop_ExpireInStore(t *testing.T) {
+	store := newMemoryStore()
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{
+		ShardSize:      1,
+		MaxCacheSize:   KB,
+		SecondaryStore: store,
+		OnRemove:       true,
+		Clock:          clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 20; i++ {
+		_ = tip.SetWithTTL(fmt.Sprintf("key-%d", i), value, time.Minute)
+	}
+	if ok, _ := store.Exists("key-0", 0); !ok {
+		t.Fatal("expected key-0 is demoted")
+	}
+
+	// the entry only in the store is rewritten there
+	if err := tip.Expire("key-0", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if store.expires["key-0"] != time.Hour {
+		t.Fatalf("unexpected expiration in store %v", store.expires["key-0"])
+	}
+	if ttl, err := tip.TTL("key-0"); err != nil || ttl != time.Hour {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+	if err := tip.Persist("key-0"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Hour)
+	if got, err := tip.Get("key-0"); err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+}
+
+func TestTipTop_ExpireWriteThrough(t *testing.T) {
+	store := newMemoryStore()
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{
+		ShardSize:            1,
+		SecondaryStore:       store,
+		WriteMode:            WriteThrough,
+		StaleWhileRevalidate: 10 * time.Second,
+		Loader:               func(key string) ([]byte, error) { return nil, ErrKeyMissing },
+		Clock:                clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	_ = tip.SetWithTTL("key", []byte("v"), time.Minute)
+	if err := tip.Expire("key", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// the secondary cache keeps the stale entry as long as in-memory.
+	if store.expires["key"] != time.Hour+10*time.Second {
+		t.Fatalf("unexpected expiration in store %v", store.expires["key"])
+	}
+	if ttl, err := tip.TTL("key"); err != nil || ttl != time.Hour {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+}
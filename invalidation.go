@@ -0,0 +1,78 @@
+package tiptop
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/go-redis/redis"
+	"strings"
+	"sync/atomic"
+)
+
+// invalidationSeparator separates the origin and the key in the message of invalidation.
+const invalidationSeparator = ":"
+
+// invalidator publishes the keys mutated by the TipTop on a channel of redis, and drops the entries of
+// the keys published by the other TipTop from in-memory, so the replicas sharing one redis don't keep
+// the stale entries. The messages published by itself are ignored by the origin of the message.
+type invalidator struct {
+	client  *redis.Client
+	channel string
+	origin  string
+	pubsub  *redis.PubSub
+	handler func(key string)
+
+	received int64
+}
+
+func newInvalidator(client *redis.Client, channel string, handler func(key string)) (*invalidator, error) {
+	origin := make([]byte, 8)
+	if _, err := rand.Read(origin); err != nil {
+		return nil, err
+	}
+	i := &invalidator{
+		client:  client,
+		channel: channel,
+		origin:  hex.EncodeToString(origin),
+		handler: handler,
+	}
+
+	i.pubsub = client.Subscribe(channel)
+	// wait for the confirmation of subscription, so no message is lost after NewTipTop returns.
+	if _, err := i.pubsub.Receive(); err != nil {
+		_ = i.pubsub.Close()
+		return nil, err
+	}
+	go i.run(i.pubsub.Channel())
+	return i, nil
+}
+
+// publish broadcasts the key to the other TipTop.
+func (i *invalidator) publish(key string) error {
+	return i.client.Publish(i.channel, i.origin+invalidationSeparator+key).Err()
+}
+
+func (i *invalidator) run(messages <-chan *redis.Message) {
+	for message := range messages {
+		i.receive(message.Payload)
+	}
+}
+
+// receive drops the entry of the key in the message unless the message is published by itself.
+func (i *invalidator) receive(payload string) {
+	parts := strings.SplitN(payload, invalidationSeparator, 2)
+	if len(parts) != 2 || parts[0] == i.origin {
+		return
+	}
+	atomic.AddInt64(&i.received, 1)
+	i.handler(parts[1])
+}
+
+func (i *invalidator) close() error {
+	return i.pubsub.Close()
+}
+
+func (i *invalidator) getStats() Stats {
+	return Stats{
+		Invalidations: atomic.LoadInt64(&i.received),
+	}
+}
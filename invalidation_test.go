@@ -0,0 +1,109 @@
+package tiptop
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvalidator_Receive(t *testing.T) {
+	tip, err := NewTipTop(Config{ShardSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	_ = tip.Set("key", []byte("value"))
+	i := &invalidator{origin: "self", handler: tip.invalidate}
+
+	// the message published by itself is ignored
+	i.receive("self" + invalidationSeparator + "key")
+	if _, err := tip.Get("key"); err != nil {
+		t.Fatalf("expected the key is kept, got %v", err)
+	}
+
+	// the key contains the separator as well
+	_ = tip.Set("key:with:separator", []byte("value"))
+	i.receive("other" + invalidationSeparator + "key:with:separator")
+	i.receive("other" + invalidationSeparator + "key")
+	if _, err := tip.Get("key"); err != errKeyNotFound {
+		t.Fatalf("expected errKeyNotFound, got %v", err)
+	}
+	if _, err := tip.Get("key:with:separator"); err != errKeyNotFound {
+		t.Fatalf("expected errKeyNotFound, got %v", err)
+	}
+	if received := i.getStats().Invalidations; received != 2 {
+		t.Fatalf("unexpected invalidations %d", received)
+	}
+}
+
+// hookStore is a memoryStore which calls the hook once Get reads the entry.
+type hookStore struct {
+	*memoryStore
+	hook func()
+}
+
+func (h *hookStore) Get(key string, hash uint64) ([]byte, error) {
+	entry, err := h.memoryStore.Get(key, hash)
+	if h.hook != nil {
+		h.hook()
+	}
+	return entry, err
+}
+
+func TestInvalidator_RacingRead(t *testing.T) {
+	store := &hookStore{memoryStore: newMemoryStore()}
+	tip, err := NewTipTop(Config{ShardSize: 1, SecondaryStore: store, WriteMode: WriteThrough})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	_ = tip.SetWithTTL("key", []byte("former"), time.Hour)
+	tip.invalidate("key")
+	// the key is invalidated again while the former value is read from the store
+	store.hook = func() { tip.invalidate("key") }
+	if got, err := tip.Get("key"); err != nil || string(got) != "former" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if tip.Len() != 0 {
+		t.Fatal("expected the value read before the invalidation isn't promoted")
+	}
+
+	// the value read without invalidation is promoted
+	store.hook = nil
+	if _, err := tip.Get("key"); err != nil {
+		t.Fatal(err)
+	}
+	if tip.Len() != 1 {
+		t.Fatal("expected the value is promoted")
+	}
+}
+
+func TestInvalidator_RequireRedis(t *testing.T) {
+	_, err := NewTipTop(Config{
+		ShardSize:           1,
+		SecondaryStore:      newMemoryStore(),
+		WriteMode:           WriteThrough,
+		InvalidationChannel: "tiptop",
+	})
+	if err == nil {
+		t.Fatal("expected the error of invalidation channel without redis")
+	}
+}
+
+func TestInvalidator_RequireWriteThrough(t *testing.T) {
+	// the replica would read the former value from redis, which isn't replaced by the value published yet
+	// by write-behind, or never by evict-only.
+	server := newTestRedis(t)
+	for _, mode := range []WriteMode{WriteEvictOnly, WriteBehind} {
+		_, err := NewTipTop(Config{
+			ShardSize:           1,
+			RedisAddr:           server.Addr(),
+			OnRemove:            true,
+			WriteMode:           mode,
+			InvalidationChannel: "tiptop",
+		})
+		if err == nil {
+			t.Fatalf("expected the error of invalidation channel with write mode %d", mode)
+		}
+	}
+}
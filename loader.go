@@ -0,0 +1,129 @@
+package tiptop
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Loader loads the value of the key from the source of data when the key is missing in cache.
+// The loader returns ErrKeyMissing if the key doesn't exist in the source of data, then the negative entry
+// of the key is saved, so the key won't be loaded again until MissingTTL passes.
+// The panic of the loader is recovered and returned as the error to all callers waiting for the key.
+type Loader func(key string) ([]byte, error)
+
+// loadCall is a call of Loader in progress or completed.
+type loadCall struct {
+	wg    sync.WaitGroup
+	value []byte
+	err   error
+}
+
+// loadGroup deduplicates the concurrent loads of the same key, the goroutines loading the key
+// wait for the call in progress and share its result, so the source of data is loaded once.
+type loadGroup struct {
+	lock  sync.Mutex
+	calls map[string]*loadCall
+
+	loads         int64
+	errors        int64
+	time          int64
+	refreshes     int64
+	refreshErrors int64
+}
+
+func newLoadGroup() *loadGroup {
+	return &loadGroup{
+		calls: make(map[string]*loadCall),
+	}
+}
+
+// do calls the loader of the key unless there is a call in progress, and returns the result of the call.
+// The store is called with the result loaded before the waiters are woken up, unless the loader fails.
+func (g *loadGroup) do(key string, loader Loader, store func(value []byte, err error)) ([]byte, error) {
+	g.lock.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		c.wg.Wait()
+		if c.err != nil {
+			return nil, c.err
+		}
+		// every waiter owns its value as same as Get
+		return append([]byte(nil), c.value...), nil
+	}
+	c := &loadCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	g.call(key, c, loader, store)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return append([]byte(nil), c.value...), nil
+}
+
+// doAsync calls the loader of the key in background unless there is a call in progress,
+// it doesn't wait for the result.
+func (g *loadGroup) doAsync(key string, loader Loader, store func(value []byte, err error)) {
+	g.lock.Lock()
+	if _, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		return
+	}
+	c := &loadCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	go func() {
+		g.call(key, c, loader, store)
+		if c.err != nil && c.err != ErrKeyMissing {
+			atomic.AddInt64(&g.refreshErrors, 1)
+		} else {
+			atomic.AddInt64(&g.refreshes, 1)
+		}
+	}()
+}
+
+// call runs the loader and wakes up the waiters of the call.
+func (g *loadGroup) call(key string, c *loadCall, loader Loader, store func(value []byte, err error)) {
+	defer func() {
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		c.wg.Done()
+	}()
+
+	start := time.Now()
+	c.value, c.err = load(key, loader)
+	atomic.AddInt64(&g.time, int64(time.Since(start)))
+	atomic.AddInt64(&g.loads, 1)
+	if c.err != nil && c.err != ErrKeyMissing {
+		atomic.AddInt64(&g.errors, 1)
+	} else {
+		store(c.value, c.err)
+	}
+}
+
+// load runs the loader, the panic of the loader is recovered and returned as the error.
+func load(key string, loader Loader) (value []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("loader panics: %v", r)
+		}
+	}()
+	return loader(key)
+}
+
+func (g *loadGroup) getStats() Stats {
+	return Stats{
+		Loads:      atomic.LoadInt64(&g.loads),
+		LoadErrors: atomic.LoadInt64(&g.errors),
+		LoadTime:   atomic.LoadInt64(&g.time),
+
+		Refreshes:     atomic.LoadInt64(&g.refreshes),
+		RefreshErrors: atomic.LoadInt64(&g.refreshErrors),
+	}
+}
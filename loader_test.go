@@ -0,0 +1,261 @@
+package tiptop
+
+import (
+	"errors"
+	"guriytan.cn/tiptop/clocktest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTipTop_GetOrLoad(t *testing.T) {
+	tip, err := NewTipTop(Config{ShardSize: 1, LoadTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	var calls int64
+	release := make(chan struct{})
+	loader := func(key string) ([]byte, error) {
+		atomic.AddInt64(&calls, 1)
+		<-release
+		return []byte("value-of-" + key), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := tip.GetOrLoad("key", loader); err != nil || string(got) != "value-of-key" {
+				t.Errorf("unexpected %q, %v", got, err)
+			}
+		}()
+	}
+	waitFor(t, func() bool { return atomic.LoadInt64(&calls) == 1 })
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("expected the loader is called once, got %d", calls)
+	}
+	// the value loaded is cached
+	if got, err := tip.Get("key"); err != nil || string(got) != "value-of-key" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if _, err := tip.GetOrLoad("key", loader); err != nil || calls != 1 {
+		t.Fatalf("expected the cached value is read, got %v, %d calls", err, calls)
+	}
+	if stats := tip.GetStats(); stats.Loads != 1 || stats.LoadErrors != 0 || stats.LoadTime <= 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestTipTop_GetOrLoadError(t *testing.T) {
+	errSource := errors.New("source is unavailable")
+	tip, err := NewTipTop(Config{
+		ShardSize: 1,
+		Loader: func(key string) ([]byte, error) {
+			return nil, errSource
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	if _, err := tip.GetOrLoad("key", nil); err != errSource {
+		t.Fatalf("expected errSource, got %v", err)
+	}
+	if _, err := tip.Get("key"); err != errKeyNotFound {
+		t.Fatalf("expected the error is not cached, got %v", err)
+	}
+	if stats := tip.GetStats(); stats.Loads != 1 || stats.LoadErrors != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	tip, _ = NewTipTop(Config{ShardSize: 1})
+	defer tip.Close()
+	if _, err := tip.GetOrLoad("key", nil); err != errNoLoader {
+		t.Fatalf("expected errNoLoader, got %v", err)
+	}
+}
+
+func TestTipTop_GetOrLoadPanic(t *testing.T) {
+	tip, err := NewTipTop(Config{ShardSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	release := make(chan struct{})
+	panicking := func(key string) ([]byte, error) {
+		<-release
+		panic("source is broken")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tip.GetOrLoad("key", panicking); err == nil {
+				t.Error("expected the panic is returned as error")
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+
+	// the key is loaded again after the panic
+	loader := func(key string) ([]byte, error) { return []byte("value"), nil }
+	if got, err := tip.GetOrLoad("key", loader); err != nil || string(got) != "value" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if stats := tip.GetStats(); stats.LoadErrors == 0 || stats.Loads != stats.LoadErrors+1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestTipTop_StaleWhileRevalidate(t *testing.T) {
+	var calls int64
+	release := make(chan struct{})
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{
+		ShardSize:            1,
+		Clock:                clock,
+		LoadTTL:              time.Minute,
+		StaleWhileRevalidate: 10 * time.Second,
+		Loader: func(key string) ([]byte, error) {
+			atomic.AddInt64(&calls, 1)
+			<-release
+			return []byte("fresh"), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	_ = tip.SetWithTTL("key", []byte("stale"), time.Second)
+	clock.Advance(5 * time.Second)
+
+	// the stale value is served by all the readers while it is refreshed once
+	for i := 0; i < 10; i++ {
+		if got, err := tip.Get("key"); err != nil || string(got) != "stale" {
+			t.Fatalf("unexpected %q, %v", got, err)
+		}
+	}
+	close(release)
+	waitFor(t, func() bool { return tip.GetStats().Refreshes == 1 })
+	if got, err := tip.Get("key"); err != nil || string(got) != "fresh" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if stats := tip.GetStats(); calls != 1 || stats.StaleHits != 10 || stats.Hits != 11 || stats.RefreshErrors != 0 {
+		t.Fatalf("unexpected %d calls, stats %+v", calls, stats)
+	}
+
+	// the entry is removed once the stale period passes
+	_ = tip.SetWithTTL("key", []byte("stale"), time.Second)
+	clock.Advance(12 * time.Second)
+	if _, err := tip.Get("key"); err != errEntryIsDead {
+		t.Fatalf("expected errEntryIsDead, got %v", err)
+	}
+}
+
+func TestTipTop_StaleWhileRevalidateTTL(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{
+		ShardSize:            1,
+		Clock:                clock,
+		StaleWhileRevalidate: 10 * time.Second,
+		Loader: func(key string) ([]byte, error) {
+			return []byte("fresh"), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	// the refreshed entries keep their ttl rather than LoadTTL which never expires
+	_ = tip.SetWithTTL("key", []byte("stale"), time.Minute)
+	_ = tip.SetWithIdle("sliding", []byte("stale"), 55*time.Second)
+	clock.Advance(61 * time.Second)
+	for _, key := range []string{"key", "sliding"} {
+		if got, err := tip.Get(key); err != nil || string(got) != "stale" {
+			t.Fatalf("unexpected %q, %v", got, err)
+		}
+	}
+	waitFor(t, func() bool { return tip.GetStats().Refreshes == 2 })
+	if ttl, err := tip.TTL("key"); err != nil || ttl != time.Minute {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+	if ttl, err := tip.TTL("sliding"); err != nil || ttl != 55*time.Second {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+
+	// the refreshed entry is still sliding
+	clock.Advance(20 * time.Second)
+	if got, err := tip.Get("sliding"); err != nil || string(got) != "fresh" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if ttl, _ := tip.TTL("sliding"); ttl != 55*time.Second {
+		t.Fatalf("expected the refreshed entry slides, got %v", ttl)
+	}
+}
+
+func TestTipTop_StaleWhileRevalidateError(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{
+		ShardSize:            1,
+		Clock:                clock,
+		StaleWhileRevalidate: 10 * time.Second,
+		Loader: func(key string) ([]byte, error) {
+			return nil, errors.New("source is unavailable")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	_ = tip.SetWithTTL("key", []byte("stale"), time.Second)
+	clock.Advance(5 * time.Second)
+	if got, err := tip.Get("key"); err != nil || string(got) != "stale" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	waitFor(t, func() bool { return tip.GetStats().RefreshErrors == 1 })
+	// the stale value is kept when the refresh fails
+	if got, err := tip.Get("key"); err != nil || string(got) != "stale" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+
+	if _, err := NewTipTop(Config{ShardSize: 1, StaleWhileRevalidate: time.Second}); err == nil {
+		t.Fatal("expected error without loader")
+	}
+}
+
+func TestTipTop_GetOrLoadMissing(t *testing.T) {
+	var calls int64
+	tip, err := NewTipTop(Config{
+		ShardSize: 1,
+		Loader: func(key string) ([]byte, error) {
+			atomic.AddInt64(&calls, 1)
+			return nil, ErrKeyMissing
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := tip.GetOrLoad("key", nil); err != ErrKeyMissing {
+			t.Fatalf("expected ErrKeyMissing, got %v", err)
+		}
+	}
+	if stats := tip.GetStats(); calls != 1 || stats.LoadErrors != 0 || stats.MissingHits != 2 {
+		t.Fatalf("unexpected %d calls, stats %+v", calls, stats)
+	}
+}
@@ -3,60 +3,91 @@ package tiptop
 import (
 	"github.com/go-redis/redis"
 	"strconv"
-	"sync"
 	"time"
 )
 
+// KeyPrefix is the prefix of the records stored in redis.
+//
+// Deprecated: Use DefaultKeyPrefix, the prefix is set by Config.KeyPrefix.
+const KeyPrefix = DefaultKeyPrefix
+
+// redisCache is the SecondaryStore using redis.
+// All records are named with the prefix, so several services can share one redis.
 type redisCache struct {
-	client *redis.Client
+	client   *redis.Client
+	prefix   string
+	storeKey bool
 }
 
-const KeyPrefix = "tiptop::key::"
-
-var (
-	one   sync.Once
-	cache *redisCache
-)
+// NewRedisStore returns a SecondaryStore which stores the entries in the redis of the client.
+// The records are named by the prefix plus the sum64 of the key, or plus the key itself if the storeKey is true.
+func NewRedisStore(client *redis.Client, prefix string, storeKey bool) SecondaryStore {
+	return &redisCache{
+		client:   client,
+		prefix:   prefix,
+		storeKey: storeKey,
+	}
+}
 
+// newRedisCache connects to the redis of the config, every TipTop owns its client.
 func newRedisCache(config *Config) (*redisCache, error) {
-	var err error
-	one.Do(func() {
-		client, err := newRedisClient(config)
-		if err != nil {
-			return
-		}
-		cache = &redisCache{client}
-	})
-	return cache, err
+	client, err := newRedisClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &redisCache{
+		client:   client,
+		prefix:   config.KeyPrefix,
+		storeKey: config.RedisStoreKey,
+	}, nil
 }
 
-func (redis *redisCache) getKey(key uint64) ([]byte, error) {
-	return redis.client.Get(KeyPrefix + strconv.FormatUint(key, 10)).Bytes()
+// name returns the name of the record in redis.
+func (redis *redisCache) name(key string, hash uint64) string {
+	if redis.storeKey {
+		return redis.prefix + key
+	}
+	return redis.prefix + strconv.FormatUint(hash, 10)
+}
+
+func (redis *redisCache) Get(key string, hash uint64) ([]byte, error) {
+	return redis.client.Get(redis.name(key, hash)).Bytes()
 }
 
-func (redis *redisCache) setKey(key uint64, value []byte, expiration int64) {
-	if expiration > 0 && expiration > time.Now().Unix() {
-		redis.client.Set(KeyPrefix+strconv.FormatUint(key, 10), value, time.Duration(expiration-time.Now().Unix()))
-	} else if expiration == 0 {
-		redis.client.Set(KeyPrefix+strconv.FormatUint(key, 10), value, time.Duration(0))
+func (redis *redisCache) Set(key string, hash uint64, value []byte, expiration time.Duration) error {
+	return redis.client.Set(redis.name(key, hash), value, expiration).Err()
+}
+
+// SetBatch stores the entries by a pipeline.
+func (redis *redisCache) SetBatch(entries []StoreEntry) error {
+	pipe := redis.client.Pipeline()
+	for _, e := range entries {
+		pipe.Set(redis.name(e.Key, e.Hash), e.Entry, e.Expiration)
 	}
+	_, err := pipe.Exec()
+	return err
 }
 
-func (redis *redisCache) delKey(key uint64) {
-	redis.client.Del(KeyPrefix + strconv.FormatUint(key, 10))
+func (redis *redisCache) Delete(key string, hash uint64) error {
+	return redis.client.Del(redis.name(key, hash)).Err()
 }
 
-func (redis *redisCache) exist(key uint64) bool {
-	return redis.client.Exists(KeyPrefix+strconv.FormatUint(key, 10)).Val() != 0
+func (redis *redisCache) Exists(key string, hash uint64) (bool, error) {
+	n, err := redis.client.Exists(redis.name(key, hash)).Result()
+	return n != 0, err
 }
 
-func (redis *redisCache) reset() {
-	iterator := redis.client.Scan(0, KeyPrefix+"*", 10).Iterator()
+// Reset removes the records with the prefix only.
+func (redis *redisCache) Reset() error {
+	iterator := redis.client.Scan(0, redis.prefix+"*", 10).Iterator()
 	for iterator.Next() {
-		redis.client.Del(iterator.Val())
+		if err := redis.client.Del(iterator.Val()).Err(); err != nil {
+			return err
+		}
 	}
+	return iterator.Err()
 }
 
-func (redis *redisCache) close() {
-	_ = redis.client.Close()
+func (redis *redisCache) Close() error {
+	return redis.client.Close()
 }
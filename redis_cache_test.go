@@ -1,34 +1,270 @@
 package tiptop
 
 import (
+	"bytes"
 	"fmt"
+	"guriytan.cn/tiptop/clocktest"
+	"guriytan.cn/tiptop/redistest"
+	"strconv"
 	"testing"
 	"time"
 )
 
+// newTestRedis starts a redistest.Server which is closed when the test finishes.
+func newTestRedis(tb testing.TB) *redistest.Server {
+	server, err := redistest.NewServer()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = server.Close() })
+	return server
+}
+
 func TestRedisCache_Clean(t *testing.T) {
-	client, _ := newRedisClient(&Config{
-		RedisAddr: "172.18.29.81:6379",
+	server := newTestRedis(t)
+	client, err := newRedisClient(&Config{
+		RedisAddr: server.Addr(),
 	})
-	if err := client.Ping().Err(); err != nil {
-		fmt.Println(err.Error())
-	}
-	client.Set(KeyPrefix+"1", "test1", time.Minute)
-	client.Set(KeyPrefix+"2", "test2", time.Minute)
-	client.Set(KeyPrefix+"3", "test3", time.Minute)
-	client.Set(KeyPrefix+"4", "test4", time.Minute)
-	iterator := client.Scan(0, KeyPrefix+"*", 2).Iterator()
-	for iterator.Next() {
-		fmt.Println(iterator.Val())
+	if err != nil {
+		t.Fatal(err)
 	}
-	fmt.Println("开始删除")
-	iterator = client.Scan(0, KeyPrefix+"*", 2).Iterator()
+	defer client.Close()
+	client.Set(DefaultKeyPrefix+"1", "test1", time.Minute)
+	client.Set(DefaultKeyPrefix+"2", "test2", time.Minute)
+	client.Set(DefaultKeyPrefix+"3", "test3", time.Minute)
+	client.Set(DefaultKeyPrefix+"4", "test4", time.Minute)
+	client.Set("other::1", "test1", time.Minute)
+	var keys []string
+	iterator := client.Scan(0, DefaultKeyPrefix+"*", 2).Iterator()
 	for iterator.Next() {
-		client.Del(iterator.Val())
+		keys = append(keys, iterator.Val())
 	}
-	fmt.Println("删除成功")
-	iterator = client.Scan(0, KeyPrefix+"*", 2).Iterator()
-	for iterator.Next() {
-		fmt.Println(iterator.Val())
+	if len(keys) != 4 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	store := &redisCache{client: client, prefix: DefaultKeyPrefix}
+	if err := store.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.Keys(); len(keys) != 1 || keys[0] != "other::1" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestRedisCache_ResetManyKeys(t *testing.T) {
+	server := newTestRedis(t)
+	client, err := newRedisClient(&Config{
+		RedisAddr: server.Addr(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// the keys are more than COUNT of SCAN, and deleted while iterating
+	for i := 0; i < 50; i++ {
+		client.Set(fmt.Sprintf("%s%d", DefaultKeyPrefix, i), "test", time.Minute)
+	}
+	client.Set("other::1", "test1", time.Minute)
+
+	store := &redisCache{client: client, prefix: DefaultKeyPrefix}
+	if err := store.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.Keys(); len(keys) != 1 || keys[0] != "other::1" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestRedisCache_DemoteAndPromote(t *testing.T) {
+	server := newTestRedis(t)
+	clock := clocktest.NewClock(time.Now())
+	server.SetClock(clock)
+	tip, err := NewTipTop(Config{
+		ShardSize:     1,
+		MaxCacheSize:  KB,
+		RedisAddr:     server.Addr(),
+		RedisStoreKey: true,
+		OnRemove:      true,
+		Clock:         clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	_ = tip.SetWithTTL("key-0", value, time.Minute)
+	clock.Advance(10 * time.Second)
+	for i := 1; i < 20; i++ {
+		_ = tip.SetWithTTL(fmt.Sprintf("key-%d", i), value, time.Minute)
+	}
+	// the remaining ttl is demoted
+	if ttl, ok := server.TTL(DefaultKeyPrefix + "key-0"); !ok || ttl != 50*time.Second {
+		t.Fatalf("expected key-0 is demoted with its ttl, got %v, %v", ttl, ok)
+	}
+
+	if got, err := tip.Get("key-0"); err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if _, ok := server.TTL(DefaultKeyPrefix + "key-0"); ok {
+		t.Fatal("expected the promoted key is deleted from redis")
+	}
+	for i := 0; i < 20; i++ {
+		if got, err := tip.Get(fmt.Sprintf("key-%d", i)); err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("unexpected key-%d %q, %v", i, got, err)
+		}
+	}
+	if stats := tip.GetStats(); stats.HitsRedis == 0 || stats.Sync != stats.HitsRedis {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// the key only in redis is deleted as well
+	if err := tip.Delete("key-1"); err != nil && err != errKeyNotFound {
+		t.Fatal(err)
+	}
+	if _, err := tip.Get("key-1"); err != errKeyNotFound {
+		t.Fatalf("expected errKeyNotFound, got %v", err)
+	}
+}
+
+func TestRedisCache_KeyPrefix(t *testing.T) {
+	server := newTestRedis(t)
+	config := Config{
+		ShardSize:  1,
+		RedisAddr:  server.Addr(),
+		WriteMode:  WriteThrough,
+		KeyPrefix:  "first::",
+		DefaultTTL: time.Minute,
+	}
+	first, err := NewTipTop(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	config.KeyPrefix = "second::"
+	config.RedisStoreKey = true
+	second, err := NewTipTop(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	_ = first.Set("key", []byte("first"))
+	_ = second.Set("key", []byte("second"))
+	hash := strconv.FormatUint(defaultHashCalculator().sum64("key"), 10)
+	if keys := server.Keys(); len(keys) != 2 || keys[0] != "first::"+hash || keys[1] != "second::key" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	// reset doesn't clobber the data of the others
+	second.Reset()
+	if keys := server.Keys(); len(keys) != 1 || keys[0] != "first::"+hash {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestRedisCache_AsyncDemotion(t *testing.T) {
+	server := newTestRedis(t)
+	tip, err := NewTipTop(Config{
+		ShardSize:     1,
+		MaxCacheSize:  KB,
+		RedisAddr:     server.Addr(),
+		RedisStoreKey: true,
+		OnRemove:      true,
+		AsyncDemotion: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 20; i++ {
+		_ = tip.Set(fmt.Sprintf("key-%d", i), value)
+	}
+	_ = tip.Close()
+	stats := tip.GetStats()
+	if stats.DemotionFlushed == 0 || len(server.Keys()) != int(stats.DemotionFlushed) {
+		t.Fatalf("unexpected stats %+v, keys %v", stats, server.Keys())
+	}
+}
+
+func TestRedisCache_Password(t *testing.T) {
+	server, err := redistest.NewServerWithPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	config := Config{ShardSize: 1, RedisAddr: server.Addr(), OnRemove: true}
+	if _, err := NewTipTop(config); err == nil {
+		t.Fatal("expected the error of authentication")
+	}
+	config.RedisPwd = "secret"
+	tip, err := NewTipTop(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = tip.Close()
+}
+
+func TestRedisCache_Invalidation(t *testing.T) {
+	server := newTestRedis(t)
+	config := Config{
+		ShardSize:           1,
+		RedisAddr:           server.Addr(),
+		WriteMode:           WriteThrough,
+		InvalidationChannel: "tiptop::invalidation",
+	}
+	first, err := NewTipTop(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := NewTipTop(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	_ = first.Set("key", []byte("old"))
+	if got, err := second.Get("key"); err != nil || string(got) != "old" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+
+	// the stale entry in the second is dropped and read from redis again
+	_ = first.Set("key", []byte("new"))
+	waitFor(t, func() bool { return second.GetStats().Invalidations == 2 })
+	if got, err := second.Get("key"); err != nil || string(got) != "new" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if got, err := first.Get("key"); err != nil || string(got) != "new" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if stats := first.GetStats(); stats.Invalidations != 0 {
+		t.Fatalf("expected no invalidation from itself, stats %+v", stats)
+	}
+}
+
+func TestNewTipTop_RedisUnreachable(t *testing.T) {
+	_, err := NewTipTop(Config{
+		ShardSize: 1,
+		RedisAddr: "127.0.0.1:1",
+		OnRemove:  true,
+	})
+	if err == nil {
+		t.Fatal("expected the error of connecting to redis")
+	}
+}
+
+func TestRedisCache_Name(t *testing.T) {
+	hash := defaultHashCalculator().sum64("key")
+	byHash := &redisCache{prefix: "service::"}
+	if name := byHash.name("key", hash); name != "service::"+strconv.FormatUint(hash, 10) {
+		t.Fatalf("unexpected name %s", name)
+	}
+	byKey := &redisCache{prefix: "service::", storeKey: true}
+	if name := byKey.name("key", hash); name != "service::key" {
+		t.Fatalf("unexpected name %s", name)
 	}
 }
@@ -25,9 +25,10 @@ func newRedisClient(config *Config) (*redis.Client, error) {
 		Password:     config.RedisPwd,
 		MinIdleConns: minIdle,
 		PoolSize:     poolSize,
-		IdleTimeout:  time.Duration(RedisTimeout),
+		IdleTimeout:  RedisTimeout * time.Millisecond,
 	})
 	if err := client.Ping().Err(); err != nil {
+		_ = client.Close()
 		return nil, err
 	}
 	return client, nil
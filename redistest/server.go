@@ -0,0 +1,581 @@
+// Package redistest provides an in-process Redis speaking RESP2 for the tests of the Redis tier,
+// so they can run offline. Only the commands used by tiptop are supported:
+// PING, AUTH, GET, SET with EX and PX, DEL, EXISTS, PTTL, SCAN with MATCH and COUNT,
+// PUBLISH, SUBSCRIBE and UNSUBSCRIBE.
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is an in-process Redis listening on a random port of localhost.
+type Server struct {
+	listener net.Listener
+	password string
+
+	lock        sync.Mutex
+	data        map[string]item
+	conns       map[*conn]struct{}
+	subscribers map[string]map[*conn]struct{}
+	// cursors keeps the last key returned by SCAN under the cursor resuming it, so the keys deleted or added
+	// while iterating don't shift the keys not returned yet.
+	cursors    map[uint64]string
+	lastCursor uint64
+	wg         sync.WaitGroup
+
+	clockLock sync.Mutex
+	clock     Clock
+}
+
+// Clock provides the current time to the expiration of keys.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock of the system time.
+type systemClock struct {
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// item is a value with its expiration, zero expireAt means never expired.
+type item struct {
+	value    []byte
+	expireAt time.Time
+}
+
+// conn is a connection of client.
+type conn struct {
+	net.Conn
+	writer   *bufio.Writer
+	lock     sync.Mutex
+	authed   bool
+	channels map[string]struct{}
+}
+
+var errSyntax = errors.New("ERR syntax error")
+
+// NewServer starts a Server.
+func NewServer() (*Server, error) {
+	return NewServerWithPassword("")
+}
+
+// NewServerWithPassword starts a Server which requires the password by AUTH.
+func NewServerWithPassword(password string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener:    listener,
+		password:    password,
+		data:        make(map[string]item),
+		conns:       make(map[*conn]struct{}),
+		subscribers: make(map[string]map[*conn]struct{}),
+		cursors:     make(map[uint64]string),
+		clock:       systemClock{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address of the Server, which is "addr:port".
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the Server and closes all connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.lock.Lock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// SetClock replaces the clock by which the keys expire, such as the one of clocktest,
+// so the expiration can be verified without sleeping.
+func (s *Server) SetClock(clock Clock) {
+	s.clockLock.Lock()
+	defer s.clockLock.Unlock()
+	s.clock = clock
+}
+
+// now returns the current time of the clock.
+func (s *Server) now() time.Time {
+	s.clockLock.Lock()
+	defer s.clockLock.Unlock()
+	return s.clock.Now()
+}
+
+// Keys returns the keys which are not expired in order.
+func (s *Server) Keys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.keys()
+}
+
+// TTL returns the remaining time to live of the key, 0 if the key never expires,
+// and reports whether the key exists.
+func (s *Server) TTL(key string) (time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	it, ok := s.get(key)
+	if !ok || it.expireAt.IsZero() {
+		return 0, ok
+	}
+	return it.expireAt.Sub(s.now()), true
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{
+			Conn:     nc,
+			writer:   bufio.NewWriter(nc),
+			authed:   s.password == "",
+			channels: make(map[string]struct{}),
+		}
+		s.lock.Lock()
+		s.conns[c] = struct{}{}
+		s.lock.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+// handle executes the commands of the connection until it is closed.
+func (s *Server) handle(c *conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, c)
+		for channel := range c.channels {
+			delete(s.subscribers[channel], c)
+		}
+		s.lock.Unlock()
+		_ = c.Close()
+	}()
+
+	reader := bufio.NewReader(c)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		c.lock.Lock()
+		s.execute(c, strings.ToUpper(args[0]), args[1:])
+		err = c.writer.Flush()
+		c.lock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// execute runs the command and writes the reply. It must be called with the lock of conn held.
+func (s *Server) execute(c *conn, command string, args []string) {
+	if command == "AUTH" {
+		if len(args) != 1 {
+			writeError(c.writer, wrongArgs(command))
+		} else if s.password == "" {
+			writeError(c.writer, errors.New("ERR Client sent AUTH, but no password is set"))
+		} else if args[0] != s.password {
+			writeError(c.writer, errors.New("ERR invalid password"))
+		} else {
+			c.authed = true
+			writeSimple(c.writer, "OK")
+		}
+		return
+	}
+	if !c.authed {
+		writeError(c.writer, errors.New("NOAUTH Authentication required."))
+		return
+	}
+
+	if len(c.channels) > 0 {
+		switch command {
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+		case "PING":
+			payload := ""
+			if len(args) > 0 {
+				payload = args[0]
+			}
+			writeArray(c.writer, "pong", payload)
+			return
+		default:
+			writeError(c.writer, fmt.Errorf("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context"))
+			return
+		}
+	}
+
+	switch command {
+	case "PING":
+		if len(args) > 0 {
+			writeBulk(c.writer, []byte(args[0]))
+		} else {
+			writeSimple(c.writer, "PONG")
+		}
+	case "GET":
+		if len(args) != 1 {
+			writeError(c.writer, wrongArgs(command))
+			return
+		}
+		s.lock.Lock()
+		it, ok := s.get(args[0])
+		s.lock.Unlock()
+		if !ok {
+			writeBulk(c.writer, nil)
+			return
+		}
+		writeBulk(c.writer, it.value)
+	case "SET":
+		s.set(c, args)
+	case "DEL", "EXISTS":
+		if len(args) == 0 {
+			writeError(c.writer, wrongArgs(command))
+			return
+		}
+		var n int64
+		s.lock.Lock()
+		for _, key := range args {
+			if _, ok := s.get(key); ok {
+				n++
+				if command == "DEL" {
+					delete(s.data, key)
+				}
+			}
+		}
+		s.lock.Unlock()
+		writeInt(c.writer, n)
+	case "PTTL":
+		if len(args) != 1 {
+			writeError(c.writer, wrongArgs(command))
+			return
+		}
+		s.lock.Lock()
+		it, ok := s.get(args[0])
+		s.lock.Unlock()
+		switch {
+		case !ok:
+			writeInt(c.writer, -2)
+		case it.expireAt.IsZero():
+			writeInt(c.writer, -1)
+		default:
+			writeInt(c.writer, int64(it.expireAt.Sub(s.now())/time.Millisecond))
+		}
+	case "SCAN":
+		s.scan(c, args)
+	case "PUBLISH":
+		if len(args) != 2 {
+			writeError(c.writer, wrongArgs(command))
+			return
+		}
+		writeInt(c.writer, s.publish(args[0], args[1]))
+	case "SUBSCRIBE":
+		if len(args) == 0 {
+			writeError(c.writer, wrongArgs(command))
+			return
+		}
+		for _, channel := range args {
+			s.lock.Lock()
+			if s.subscribers[channel] == nil {
+				s.subscribers[channel] = make(map[*conn]struct{})
+			}
+			s.subscribers[channel][c] = struct{}{}
+			c.channels[channel] = struct{}{}
+			s.lock.Unlock()
+			writeArray(c.writer, "subscribe", channel, int64(len(c.channels)))
+		}
+	case "UNSUBSCRIBE":
+		channels := args
+		if len(channels) == 0 {
+			for channel := range c.channels {
+				channels = append(channels, channel)
+			}
+		}
+		for _, channel := range channels {
+			s.lock.Lock()
+			delete(s.subscribers[channel], c)
+			delete(c.channels, channel)
+			s.lock.Unlock()
+			writeArray(c.writer, "unsubscribe", channel, int64(len(c.channels)))
+		}
+	default:
+		writeError(c.writer, fmt.Errorf("ERR unknown command '%s'", command))
+	}
+}
+
+// set runs SET key value [EX seconds|PX milliseconds].
+func (s *Server) set(c *conn, args []string) {
+	if len(args) < 2 {
+		writeError(c.writer, wrongArgs("SET"))
+		return
+	}
+	it := item{value: []byte(args[1])}
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		if (option != "EX" && option != "PX") || i+1 >= len(args) {
+			writeError(c.writer, errSyntax)
+			return
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n <= 0 {
+			writeError(c.writer, errors.New("ERR invalid expire time in set"))
+			return
+		}
+		unit := time.Second
+		if option == "PX" {
+			unit = time.Millisecond
+		}
+		it.expireAt = s.now().Add(time.Duration(n) * unit)
+		i++
+	}
+	s.lock.Lock()
+	s.data[args[0]] = it
+	s.lock.Unlock()
+	writeSimple(c.writer, "OK")
+}
+
+// scan runs SCAN cursor [MATCH pattern] [COUNT count], the keys are returned in order and the cursor
+// resumes from the key after the last one returned, so every key present for the whole iteration is returned.
+func (s *Server) scan(c *conn, args []string) {
+	if len(args) == 0 {
+		writeError(c.writer, wrongArgs("SCAN"))
+		return
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		writeError(c.writer, errors.New("ERR invalid cursor"))
+		return
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			writeError(c.writer, errSyntax)
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count <= 0 {
+				writeError(c.writer, errSyntax)
+				return
+			}
+		default:
+			writeError(c.writer, errSyntax)
+			return
+		}
+	}
+
+	s.lock.Lock()
+	last, ok := s.cursors[cursor]
+	if cursor != 0 && !ok {
+		s.lock.Unlock()
+		writeError(c.writer, errors.New("ERR invalid cursor"))
+		return
+	}
+	delete(s.cursors, cursor)
+	keys := s.keys()
+	start := 0
+	if cursor != 0 {
+		start = sort.Search(len(keys), func(i int) bool { return keys[i] > last })
+	}
+	end := start + count
+	var next uint64
+	if end < len(keys) {
+		s.lastCursor++
+		next = s.lastCursor
+		s.cursors[next] = keys[end-1]
+	} else {
+		end = len(keys)
+	}
+	s.lock.Unlock()
+
+	var matched []interface{}
+	for _, key := range keys[start:end] {
+		if match(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+	writeArray(c.writer, strconv.FormatUint(next, 10), matched)
+}
+
+// publish sends the message to the subscribers of the channel, and returns the number of them.
+func (s *Server) publish(channel, message string) int64 {
+	s.lock.Lock()
+	var receivers []*conn
+	for c := range s.subscribers[channel] {
+		receivers = append(receivers, c)
+	}
+	s.lock.Unlock()
+
+	for _, c := range receivers {
+		c.lock.Lock()
+		writeArray(c.writer, "message", channel, message)
+		_ = c.writer.Flush()
+		c.lock.Unlock()
+	}
+	return int64(len(receivers))
+}
+
+// get returns the item of the key unless it is expired. It must be called with the lock held.
+func (s *Server) get(key string) (item, bool) {
+	it, ok := s.data[key]
+	if ok && !it.expireAt.IsZero() && !s.now().Before(it.expireAt) {
+		delete(s.data, key)
+		return item{}, false
+	}
+	return it, ok
+}
+
+// keys returns the keys which are not expired in order. It must be called with the lock held.
+func (s *Server) keys() []string {
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		if _, ok := s.get(key); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// match reports whether the key matches the glob-style pattern supporting '*', '?' and '\'.
+func match(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(key); i >= 0; i-- {
+				if match(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
+
+// readCommand reads a command sent as an array of bulk strings or inline.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("bulk string is expected")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func wrongArgs(command string) error {
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	_, _ = fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func writeError(w *bufio.Writer, err error) {
+	_, _ = fmt.Fprintf(w, "-%s\r\n", err.Error())
+}
+
+func writeInt(w *bufio.Writer, n int64) {
+	_, _ = fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+// writeBulk writes the bulk string, nil is written as the null bulk string.
+func writeBulk(w *bufio.Writer, data []byte) {
+	if data == nil {
+		_, _ = w.WriteString("$-1\r\n")
+		return
+	}
+	_, _ = fmt.Fprintf(w, "$%d\r\n", len(data))
+	_, _ = w.Write(data)
+	_, _ = w.WriteString("\r\n")
+}
+
+// writeArray writes the array of which the elements are string, int64 or []interface{}.
+func writeArray(w *bufio.Writer, elements ...interface{}) {
+	_, _ = fmt.Fprintf(w, "*%d\r\n", len(elements))
+	for _, element := range elements {
+		switch e := element.(type) {
+		case string:
+			writeBulk(w, []byte(e))
+		case int64:
+			writeInt(w, e)
+		case []interface{}:
+			writeArray(w, e...)
+		}
+	}
+}
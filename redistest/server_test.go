@@ -0,0 +1,167 @@
+package redistest
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"guriytan.cn/tiptop/clocktest"
+	"testing"
+	"time"
+)
+
+func newClient(t *testing.T, s *Server, password string) *redis.Client {
+	client := redis.NewClient(&redis.Options{Addr: s.Addr(), Password: password})
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+func TestServer_Commands(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	client := newClient(t, s, "")
+
+	if err := client.Ping().Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Set("key", "value", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Get("key").Result(); err != nil || got != "value" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if _, err := client.Get("unknown").Result(); err != redis.Nil {
+		t.Fatalf("expected redis.Nil, got %v", err)
+	}
+	if n := client.Exists("key", "unknown").Val(); n != 1 {
+		t.Fatalf("unexpected exists %d", n)
+	}
+	if n := client.Del("key", "unknown").Val(); n != 1 {
+		t.Fatalf("unexpected del %d", n)
+	}
+	if keys := s.Keys(); len(keys) != 0 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestServer_Expiration(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	clock := clocktest.NewClock(time.Now())
+	s.SetClock(clock)
+	client := newClient(t, s, "")
+
+	_ = client.Set("second", "value", time.Minute).Err()
+	_ = client.Set("millisecond", "value", 10*time.Millisecond).Err()
+	if ttl, ok := s.TTL("second"); !ok || ttl != time.Minute {
+		t.Fatalf("unexpected ttl %v", ttl)
+	}
+	if ttl := client.PTTL("millisecond").Val(); ttl != 10*time.Millisecond {
+		t.Fatalf("unexpected pttl %v", ttl)
+	}
+	clock.Advance(10 * time.Millisecond)
+	if _, err := client.Get("millisecond").Result(); err != redis.Nil {
+		t.Fatalf("expected redis.Nil, got %v", err)
+	}
+	if ttl, ok := s.TTL("second"); !ok || ttl != time.Minute-10*time.Millisecond {
+		t.Fatalf("unexpected ttl %v", ttl)
+	}
+}
+
+func TestServer_Scan(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	client := newClient(t, s, "")
+
+	for _, key := range []string{"a::1", "a::2", "a::3", "b::1"} {
+		_ = client.Set(key, "value", 0)
+	}
+	var keys []string
+	iterator := client.Scan(0, "a::*", 1).Iterator()
+	for iterator.Next() {
+		keys = append(keys, iterator.Val())
+	}
+	if err := iterator.Err(); err != nil || len(keys) != 3 {
+		t.Fatalf("unexpected keys %v, %v", keys, err)
+	}
+}
+
+func TestServer_ScanDelete(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	client := newClient(t, s, "")
+
+	for i := 0; i < 50; i++ {
+		_ = client.Set(fmt.Sprintf("key::%02d", i), "value", 0)
+	}
+	// the keys deleted while iterating don't make the others skipped
+	var keys []string
+	iterator := client.Scan(0, "key::*", 10).Iterator()
+	for iterator.Next() {
+		keys = append(keys, iterator.Val())
+		_ = client.Del(iterator.Val())
+	}
+	if err := iterator.Err(); err != nil || len(keys) != 50 {
+		t.Fatalf("unexpected keys %v, %v", keys, err)
+	}
+	if err := client.Scan(1<<32, "*", 10).Err(); err == nil {
+		t.Fatal("expected the error of unknown cursor")
+	}
+}
+
+func TestServer_Auth(t *testing.T) {
+	s, err := NewServerWithPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := newClient(t, s, "").Ping().Err(); err == nil {
+		t.Fatal("expected the error of authentication")
+	}
+	if err := newClient(t, s, "wrong").Ping().Err(); err == nil {
+		t.Fatal("expected the error of authentication")
+	}
+	if err := newClient(t, s, "secret").Ping().Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_PubSub(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	client := newClient(t, s, "")
+
+	pubsub := client.Subscribe("channel")
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pubsub.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.Publish("channel", "message").Val(); n != 1 {
+		t.Fatalf("unexpected receivers %d", n)
+	}
+	select {
+	case message := <-pubsub.Channel():
+		if message.Payload != "message" {
+			t.Fatalf("unexpected message %v", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message is not received")
+	}
+}
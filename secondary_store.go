@@ -0,0 +1,57 @@
+package tiptop
+
+import "time"
+
+// WriteMode decides when the entries are written to the secondary cache.
+type WriteMode int
+
+const (
+	// WriteEvictOnly writes the entry to the secondary cache only when it is removed from in-memory,
+	// and the entry is removed from the secondary cache when it is synced back to in-memory.
+	WriteEvictOnly WriteMode = iota
+	// WriteThrough writes the entry to the secondary cache on every Set and Delete before they return,
+	// so the secondary cache keeps all entries and can be shared by several TipTop as warm data.
+	// The entry is written and deleted under the write lock of shard, so the writes of a key reach the secondary
+	// cache in the same order as in-memory, and all readers of the shard wait for the round trip of the secondary
+	// cache meanwhile, WriteBehind is preferred if the secondary cache is slow. The Set failed to write returns
+	// the error of the secondary cache and isn't kept by in-memory, which is counted by WriteThroughFailed.
+	WriteThrough
+	// WriteBehind is as same as WriteThrough, but the entries set are queued and written to the
+	// secondary cache in batches every WriteBehindInterval.
+	WriteBehind
+)
+
+// SecondaryStore is the secondary cache behind the in-memory one. When the OnRemove is true,
+// the oldest entry removed from in-memory is stored in it, and will be read back and synced to
+// in-memory when the key is missing in in-memory. See WriteMode for the other timing of writing.
+// The entries are given with both the key and the sum64 of the key, the implementation can keep
+// them by either one, and must be safe for concurrent use.
+type SecondaryStore interface {
+	// Get returns the entry stored under the key, any error is regarded as the entry is not found.
+	Get(key string, hash uint64) ([]byte, error)
+	// Set stores the entry under the key, the expiration is set to 0 means that entry never out of date.
+	// The entry is not modified by tiptop after it is given, so the store can keep it without copying.
+	Set(key string, hash uint64, entry []byte, expiration time.Duration) error
+	// Delete removes the entry stored under the key.
+	Delete(key string, hash uint64) error
+	// Exists reports whether the entry is stored under the key.
+	Exists(key string, hash uint64) (bool, error)
+	// Reset removes all entries stored by tiptop.
+	Reset() error
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// StoreEntry is an entry to be stored in SecondaryStore.
+type StoreEntry struct {
+	Key        string
+	Hash       uint64
+	Entry      []byte
+	Expiration time.Duration
+}
+
+// BatchStore is the SecondaryStore which can store several entries at once, such as the pipeline of redis.
+// The asynchronous demotion writes the entries in batches if the store implements it.
+type BatchStore interface {
+	SetBatch(entries []StoreEntry) error
+}
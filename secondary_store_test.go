@@ -0,0 +1,465 @@
+package tiptop
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"guriytan.cn/tiptop/clocktest"
+)
+
+// memoryStore is an in-process SecondaryStore used by the tests, the entries are kept by the key.
+type memoryStore struct {
+	lock    sync.Mutex
+	entries map[string][]byte
+	expires map[string]time.Duration
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		entries: make(map[string][]byte),
+		expires: make(map[string]time.Duration),
+	}
+}
+
+func (m *memoryStore) Get(key string, hash uint64) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return append([]byte(nil), entry...), nil
+}
+
+func (m *memoryStore) Set(key string, hash uint64, entry []byte, expiration time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.entries[key] = append([]byte(nil), entry...)
+	m.expires[key] = expiration
+	return nil
+}
+
+func (m *memoryStore) Delete(key string, hash uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.entries, key)
+	delete(m.expires, key)
+	return nil
+}
+
+func (m *memoryStore) Exists(key string, hash uint64) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.entries[key]
+	return ok, nil
+}
+
+func (m *memoryStore) Reset() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.entries = make(map[string][]byte)
+	m.expires = make(map[string]time.Duration)
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+func (m *memoryStore) len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.entries)
+}
+
+// retainingStore is the memoryStore keeping the entries given without copying them.
+type retainingStore struct {
+	*memoryStore
+}
+
+func (r retainingStore) Set(key string, hash uint64, entry []byte, expiration time.Duration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entries[key] = entry
+	r.expires[key] = expiration
+	return nil
+}
+
+func TestSecondaryStore_DemoteAndPromote(t *testing.T) {
+	store := newMemoryStore()
+	tip, err := NewTipTop(Config{
+		ShardSize:      1,
+		MaxCacheSize:   KB,
+		SecondaryStore: store,
+		OnRemove:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 20; i++ {
+		if err := tip.Set(fmt.Sprintf("key-%d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tip.Len()+store.len() != 20 || store.len() == 0 {
+		t.Fatalf("expected entries to be demoted, in-memory %d, store %d", tip.Len(), store.len())
+	}
+
+	// the demoted entry carries the key
+	demoted, err := store.Get("key-0", 0)
+	if err != nil || readKeyFromEntry(demoted) != "key-0" {
+		t.Fatalf("unexpected demoted entry %q, %v", demoted, err)
+	}
+
+	// the first key has been demoted to the store and is read back from there
+	got, err := tip.Get("key-0")
+	if err != nil {
+		t.Fatalf("get demoted key: %v", err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatalf("unexpected value %q", got)
+	}
+	if stats := tip.GetStats(); stats.HitsRedis != 1 || stats.Sync != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if ok, _ := store.Exists("key-0", defaultHashCalculator().sum64("key-0")); ok {
+		t.Fatal("promoted key is still in the store")
+	}
+
+	// the promoted key is served by in-memory now
+	if _, err := tip.Get("key-0"); err != nil {
+		t.Fatalf("get promoted key: %v", err)
+	}
+	if stats := tip.GetStats(); stats.HitsRedis != 1 || stats.Hits != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// an unknown key misses both levels
+	if _, err := tip.Get("unknown"); err != errKeyNotFound {
+		t.Fatalf("expected errKeyNotFound, got %v", err)
+	}
+	if stats := tip.GetStats(); stats.MissesRedis != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSecondaryStore_DropDemoted(t *testing.T) {
+	store := newMemoryStore()
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{
+		ShardSize:      1,
+		MaxCacheSize:   KB,
+		SecondaryStore: store,
+		OnRemove:       true,
+		Clock:          clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 20; i++ {
+		_ = tip.Set(fmt.Sprintf("key-%d", i), value)
+	}
+	for _, key := range []string{"key-0", "key-1"} {
+		if ok, _ := store.Exists(key, 0); !ok {
+			t.Fatalf("expected %s is demoted", key)
+		}
+	}
+
+	// the demoted entry is dropped by the set, so the deleted key isn't read back from the store
+	if err := tip.Set("key-0", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.Exists("key-0", 0); ok {
+		t.Fatal("the former entry of key-0 is still in the store")
+	}
+	if err := tip.Delete("key-0"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tip.Get("key-0"); err != errKeyNotFound {
+		t.Fatalf("expected errKeyNotFound, got %q, %v", got, err)
+	}
+
+	// the expired key isn't read back from the store either
+	if err := tip.SetWithTTL("key-1", []byte("new"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Second)
+	tip.cleanUp()
+	if got, err := tip.Get("key-1"); err != errKeyNotFound {
+		t.Fatalf("expected errKeyNotFound, got %q, %v", got, err)
+	}
+
+	// the entry demoted while the key is in-memory is dropped once it expires
+	_ = tip.SetWithTTL("key-2", []byte("new"), time.Second)
+	hash := defaultHashCalculator().sum64("key-2")
+	_ = store.Set("key-2", hash, wrapEntry(0, 0, 0, hash, crc32.ChecksumIEEE([]byte("key-2")), "key-2", value, new([]byte)), 0)
+	clock.Advance(2 * time.Second)
+	tip.cleanUp()
+	if ok, _ := store.Exists("key-2", 0); ok {
+		t.Fatal("the former entry of key-2 is still in the store")
+	}
+}
+
+func TestSecondaryStore_RetainEntry(t *testing.T) {
+	store := retainingStore{newMemoryStore()}
+	tip, err := NewTipTop(Config{
+		ShardSize:      1,
+		MaxCacheSize:   KB,
+		SecondaryStore: store,
+		OnRemove:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	// the queue of shard is reused by the later sets, which mustn't change the entries demoted
+	for i := 0; i < 40; i++ {
+		_ = tip.Set(fmt.Sprintf("key-%d", i), bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+	}
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if got, err := tip.Get(key); err != nil || !bytes.Equal(got, bytes.Repeat([]byte{byte('a' + i%26)}, 100)) {
+			t.Fatalf("unexpected %s %q, %v", key, got, err)
+		}
+	}
+}
+
+func TestSecondaryStore_Validation(t *testing.T) {
+	store := newMemoryStore()
+	tip, err := NewTipTop(Config{
+		ShardSize:      1,
+		SecondaryStore: store,
+		OnRemove:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	hash := defaultHashCalculator().sum64("key")
+
+	// an entry of another key stored under the same hash
+	var buffer []byte
+	_ = store.Set("key", hash, wrapEntry(0, 0, 0, hash, 1, "other", []byte("value"), &buffer), 0)
+	if _, err := tip.Get("key"); err != errKeyNotFound {
+		t.Fatalf("expected errKeyNotFound, got %v", err)
+	}
+
+	// an outdated entry
+	_ = store.Set("key", hash, wrapEntry(unixMilli(time.Now().Add(-time.Minute)), 0, 0, hash, crc32.ChecksumIEEE([]byte("key")), "key", []byte("value"), &buffer), 0)
+	if _, err := tip.Get("key"); err != errEntryIsDead {
+		t.Fatalf("expected errEntryIsDead, got %v", err)
+	}
+	if store.len() != 0 {
+		t.Fatal("outdated entry is still in the store")
+	}
+	if stats := tip.GetStats(); stats.MissesRedis != 2 || stats.Collision != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSecondaryStore_FormerLayout(t *testing.T) {
+	store := newMemoryStore()
+	tip, err := NewTipTop(Config{
+		ShardSize:      1,
+		SecondaryStore: store,
+		OnRemove:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	// the entries written by the former version have the headers of the expiration in seconds, the hash and
+	// the crc32, followed by the value without the key.
+	former := func(key string, expiration int64, value []byte) {
+		hash := defaultHashCalculator().sum64(key)
+		w := make([]byte, legacyHeadersSizeInBytes+len(value))
+		binary.LittleEndian.PutUint64(w, uint64(expiration))
+		binary.LittleEndian.PutUint64(w[timestampSizeInBytes:], hash)
+		binary.LittleEndian.PutUint32(w[timestampSizeInBytes+hashSizeInBytes:], crc32.ChecksumIEEE([]byte(key)))
+		copy(w[legacyHeadersSizeInBytes:], value)
+		_ = store.Set(key, hash, w, 0)
+	}
+	former("text", time.Now().Add(time.Minute).Unix(), []byte("hello"))
+	former("binary", 0, []byte{0, 0, 1, 2, 3, 4})
+	former("empty", 0, nil)
+	former("outdated", time.Now().Add(-time.Minute).Unix(), []byte("hello"))
+
+	if value, err := tip.Get("text"); err != nil || string(value) != "hello" {
+		t.Fatalf("expected the fresh entry, got %q, %v", value, err)
+	}
+	if ttl, err := tip.TTL("text"); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+	if value, err := tip.Get("binary"); err != nil || !bytes.Equal(value, []byte{0, 0, 1, 2, 3, 4}) {
+		t.Fatalf("expected the whole value, got %v, %v", value, err)
+	}
+	if value, err := tip.Get("empty"); err != nil || len(value) != 0 {
+		t.Fatalf("expected the empty value, got %v, %v", value, err)
+	}
+	if _, err := tip.Get("outdated"); err != errEntryIsDead {
+		t.Fatalf("expected errEntryIsDead, got %v", err)
+	}
+}
+
+func TestSecondaryStore_WriteThrough(t *testing.T) {
+	store := newMemoryStore()
+	config := Config{
+		ShardSize:      1,
+		SecondaryStore: store,
+		WriteMode:      WriteThrough,
+	}
+	tip, err := NewTipTop(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	_ = tip.SetWithTTL("key", []byte("value"), time.Minute)
+	if store.len() != 1 || store.expires["key"] != time.Minute {
+		t.Fatalf("expected the key is written through, store %v", store.expires)
+	}
+
+	// another instance shares the warm data, which is kept in the store after synced
+	other, err := NewTipTop(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if got, err := other.Get("key"); err != nil || string(got) != "value" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if store.len() != 1 {
+		t.Fatal("expected the key is kept in the store")
+	}
+
+	if err := tip.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if store.len() != 0 {
+		t.Fatal("expected the key is deleted from the store")
+	}
+}
+
+func TestSecondaryStore_WriteThroughFailed(t *testing.T) {
+	tip, err := NewTipTop(Config{
+		ShardSize:      1,
+		SecondaryStore: &failingStore{memoryStore: newMemoryStore()},
+		WriteMode:      WriteThrough,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	// the value not written to the secondary cache isn't kept by in-memory either, and the failure is counted
+	if err := tip.Set("fail", []byte("value")); err == nil {
+		t.Fatal("expected the error of the secondary cache")
+	}
+	if got, err := tip.Get("fail"); err == nil {
+		t.Fatalf("expected the value failed to write isn't read, got %q", got)
+	}
+	if stats := tip.GetStats(); stats.WriteThroughFailed != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// slowStore is the memoryStore whose first Set waits until it is released, after started is closed.
+type slowStore struct {
+	*memoryStore
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) Set(key string, hash uint64, entry []byte, expiration time.Duration) error {
+	if atomic.AddInt32(&s.calls, 1) == 1 {
+		close(s.started)
+		select {
+		case <-s.release:
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return s.memoryStore.Set(key, hash, entry, expiration)
+}
+
+func TestSecondaryStore_WriteThroughOrder(t *testing.T) {
+	store := &slowStore{memoryStore: newMemoryStore(), started: make(chan struct{}), release: make(chan struct{})}
+	tip, err := NewTipTop(Config{
+		ShardSize:      1,
+		SecondaryStore: store,
+		WriteMode:      WriteThrough,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	// the first set is slow to write through, the second one must not overtake it
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = tip.Set("key", []byte("first"))
+	}()
+	<-store.started
+	go func() {
+		defer wg.Done()
+		_ = tip.Set("key", []byte("second"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+
+	got, err := tip.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := store.Get("key", 0); err != nil || !bytes.Equal(readEntry(stored), got) {
+		t.Fatalf("expected the store keeps %q as in-memory, got %q, %v", got, readEntry(stored), err)
+	}
+}
+
+func TestSecondaryStore_WriteBehind(t *testing.T) {
+	store := newMemoryStore()
+	tip, err := NewTipTop(Config{
+		ShardSize:           1,
+		SecondaryStore:      store,
+		WriteMode:           WriteBehind,
+		WriteBehindInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		_ = tip.Set("key", []byte(fmt.Sprintf("value-%d", i)))
+	}
+	_ = tip.Set("deleted", []byte("value"))
+	_ = tip.Delete("deleted")
+	if store.len() != 0 {
+		t.Fatal("expected the keys are not written before the interval")
+	}
+
+	_ = tip.Close()
+	if got, err := store.Get("key", 0); err != nil || string(readEntry(got)) != "value-9" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if store.len() != 1 {
+		t.Fatal("expected the deleted key is not written")
+	}
+	if stats := tip.GetStats(); stats.WriteBehindQueued != 11 || stats.WriteBehindFlushed != 1 || stats.DemotionQueued != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -15,93 +15,130 @@ type shard struct {
 	marker  map[uint64]int
 	entries ByteQueue
 	buffer  []byte
-
-	redisCache    *redisCache
-	redisEnable   bool
-	onRemove      bool
-	InitEntrySize int
-
-	clock    clock
-	stats    Stats
-	shuffler shuffler
+	// requeueBuffer keeps the entry requeued by EvictClock, since buffer may be in use when it is removing.
+	requeueBuffer []byte
+	// window keeps the new entries before they are admitted to entries, whose indexes are negative
+	// in the marker. It is used only if the admission is on.
+	window ByteQueue
+	sketch *frequencySketch
+	// live is the bytes of the live entries in entries and window, the others are dead.
+	live int
+	// budget is the memory budget shared by all shards, nil if MemoryBudget is not set.
+	budget *memoryBudget
+	// maxEntries is the max number of entries of the shard, 0 means unlimited.
+	maxEntries int
+	// underusedSince is the time the shard becomes underused, zero if it is not.
+	underusedSince time.Time
+	// invalidations is the generation of invalidations of the shard, the entry read from the secondary store
+	// isn't promoted if any key of the shard is invalidated during the read, since it may be the former value.
+	invalidations uint64
+
+	store          SecondaryStore
+	writeMode      WriteMode
+	evictionPolicy EvictionPolicy
+	onRemove       bool
+	InitEntrySize  int
+
+	// onEvict is called with the removals once the lock is released, nil if OnEvict is not set.
+	onEvict  func(key string, value []byte, reason RemoveReason)
+	removals []removal
+
+	// staleWindow is the period after the expiration in which the stale entry is still served.
+	staleWindow time.Duration
+	// refresh reloads the stale key in background, nil if StaleWhileRevalidate is off.
+	refresh func(key string, ttl time.Duration, flags byte)
+
+	clock clock
+	stats Stats
+	// expiries tracks the expiration of the entries set with ttl.
+	expiries expiryHeap
 }
 
 var (
+	// ErrKeyMissing is returned by Get when the key is known to be missing in the source of data,
+	// which is saved by SetMissing.
+	ErrKeyMissing = errors.New("key is missing")
+
 	errKeyNotFound = errors.New("key is not found")
 	errEntryIsDead = errors.New("key is outdated")
 	errMaxEntry    = errors.New("entry is bigger than max shard size")
+	errMaxKey      = errors.New("key is bigger than 65535 bytes")
+	errNoLoader    = errors.New("loader is not set")
+	errTTLUnknown  = errors.New("ttl of key is unknown")
 )
 
-func initShard(config *Config) *shard {
+func initShard(config *Config, store SecondaryStore, budget *memoryBudget) *shard {
+	maxShardSize := config.maximumShardSize()
+	windowSize := 0
+	if config.Admission {
+		windowSize = config.admissionWindowSize()
+	}
 	shard := &shard{
 		marker:   make(map[uint64]int),
-		entries:  NewByteQueue(config.InitEntrySize, config.maximumShardSize()),
+		entries:  NewByteQueue(config.InitEntrySize, maxShardSize-windowSize),
 		buffer:   make([]byte, config.InitEntrySize),
 		lock:     sync.RWMutex{},
 		onRemove: config.OnRemove,
-
-		clock:         newDefaultClock(),
-		shuffler:      newDefaultShuffle(),
-		InitEntrySize: config.InitEntrySize,
+		store:    store,
+
+		budget:         budget,
+		onEvict:        config.OnEvict,
+		maxEntries:     config.maximumShardEntries(),
+		staleWindow:    config.StaleWhileRevalidate,
+		evictionPolicy: config.EvictionPolicy,
+		clock:          newDefaultClock(config.Clock),
+		InitEntrySize:  config.InitEntrySize,
 	}
-	if config.OnRemove && config.RedisAddr != "" {
-		client, err := newRedisCache(config)
-		if err != nil {
-			panic("init shard err: " + err.Error())
-		}
-
-		shard.redisCache = client
-		shard.redisEnable = true
+	if store != nil {
+		shard.writeMode = config.WriteMode
+	}
+	if config.Admission {
+		shard.window = NewByteQueue(0, windowSize)
+		shard.sketch = newFrequencySketch(maxShardSize)
 	}
 	return shard
 }
 
-// getWrappedEntry get the entry by the index of the hashmap
-// if the key doesn't exist in hashmap and the RedisEnable is true,
-// entry will search from the redis, and sync to the in-memory.
+// getWrappedEntry get the entry by the index of the hashmap.
+// It must be called with the lock held.
 func (s *shard) getWrappedEntry(hash uint64) ([]byte, error) {
-	s.lock.RLock()
 	itemIndex := s.marker[hash]
-
 	if itemIndex == 0 {
-		s.lock.RUnlock()
-		s.statsMiss()
 		return nil, errKeyNotFound
 	}
+	return s.getEntry(itemIndex)
+}
 
-	wrappedEntry, err := s.entries.Get(itemIndex)
-	if err != nil {
-		if s.redisEnable {
-			bytes, err := s.redisCache.getKey(hash)
-
-			s.lock.RUnlock()
-			if err != nil {
-				s.statsMissRedis()
-				return nil, errKeyNotFound
-			}
-
-			go s.sync(hash, bytes)
-			s.statsHitRedis()
-			return bytes, nil
-		}
-		s.lock.RUnlock()
-		s.statsMiss()
-		return nil, err
+// getEntry get the entry by the index of the marker, the negative index is of the window.
+// It must be called with the lock held.
+func (s *shard) getEntry(index int) ([]byte, error) {
+	if index < 0 {
+		return s.window.Get(-index)
 	}
-	s.lock.RUnlock()
-	return wrappedEntry, nil
+	return s.entries.Get(index)
 }
 
 // get by read the entry from the entries queue.
 // the crc32 will be checked to ensure the collision doesn't happened.
 // the expiration time also will be checked. If the key is outdated, errEntryIsDead will be returned.
+// if the key doesn't exist in in-memory and the secondary store is on,
+// entry will search from the secondary store, and sync to the in-memory.
 func (s *shard) get(key string, hash uint64) ([]byte, error) {
+	if s.sketch != nil {
+		s.sketch.increment(hash)
+	}
+	s.lock.RLock()
+	itemIndex := s.marker[hash]
 	wrappedEntry, err := s.getWrappedEntry(hash)
 	if err != nil {
-		return nil, err
+		s.lock.RUnlock()
+		s.statsMiss()
+		if s.store != nil {
+			return s.getFromStore(key, hash)
+		}
+		return nil, errKeyNotFound
 	}
 
-	s.lock.RLock()
 	if crc := readCRC32FromEntry(wrappedEntry); crc != crc32.ChecksumIEEE([]byte(key)) {
 		s.lock.RUnlock()
 		s.statsCollision()
@@ -109,173 +146,476 @@ func (s *shard) get(key string, hash uint64) ([]byte, error) {
 	}
 
 	timeStamp := readTimestampFromEntry(wrappedEntry)
-	if timeStamp != 0 && s.clock.epoch() > timeStamp {
+	if s.expired(timeStamp) {
 		s.lock.RUnlock()
-		go s.del(hash)
+		s.statsExpiredRead()
+		go s.del(key, hash, Expired)
 		return nil, errEntryIsDead
 	}
 
+	if readFlagsFromEntry(wrappedEntry)&flagMissing != 0 {
+		s.lock.RUnlock()
+		return nil, s.missing(key, timeStamp)
+	}
+
 	entry := readEntry(wrappedEntry)
+	promote := s.shouldPromote(itemIndex)
+	visit := s.evictionPolicy == EvictClock && readFlagsFromEntry(wrappedEntry)&flagVisited == 0
+	slide := s.shouldSlide(wrappedEntry, timeStamp)
+	stale := s.stale(timeStamp)
+	var ttl time.Duration
+	var flags byte
+	if stale {
+		ttl, flags = refreshed(wrappedEntry)
+	}
 	s.lock.RUnlock()
 	s.statsHit()
+	if slide {
+		// the entry is slid before it is promoted, since its index is changed by promote.
+		s.slide(key, hash, itemIndex)
+	}
+	if promote {
+		s.promote(hash, itemIndex)
+	}
+	if visit {
+		s.visit(hash, itemIndex)
+	}
+	if stale {
+		s.revalidate(key, ttl, flags)
+	}
 	return entry, nil
 }
 
-// sync is a synchronization to keep the data read from redis store to in-memory
-func (s *shard) sync(hash uint64, value []byte) {
+// getFromStore read the entry which has been demoted to the secondary store by removeOldest.
+// the entry is checked as same as the in-memory one, and promoted back to in-memory if valid.
+func (s *shard) getFromStore(key string, hash uint64) ([]byte, error) {
+	generation := atomic.LoadUint64(&s.invalidations)
+	wrappedEntry, err := s.store.Get(key, hash)
+	if err == nil {
+		wrappedEntry = upgradeEntry(key, wrappedEntry)
+	}
+	if err != nil || !validEntry(wrappedEntry) {
+		s.statsMissRedis()
+		return nil, errKeyNotFound
+	}
+
+	if readHashFromEntry(wrappedEntry) != hash || readCRC32FromEntry(wrappedEntry) != crc32.ChecksumIEEE([]byte(key)) {
+		s.statsMissRedis()
+		s.statsCollision()
+		return nil, errKeyNotFound
+	}
+
+	timeStamp := readTimestampFromEntry(wrappedEntry)
+	if s.expired(timeStamp) {
+		s.statsMissRedis()
+		_ = s.store.Delete(key, hash)
+		return nil, errEntryIsDead
+	}
+
+	slide := s.shouldSlide(wrappedEntry, timeStamp)
+	if slide {
+		// the entry may be shared by the store, such as the one pending to write.
+		wrappedEntry = append([]byte(nil), wrappedEntry...)
+		timeStamp = s.clock.exp(idlePeriod(wrappedEntry))
+		writeTimestampToEntry(wrappedEntry, timeStamp)
+		s.statsSlide()
+	}
+	if s.sync(hash, wrappedEntry, generation) && s.writeMode == WriteEvictOnly {
+		_ = s.store.Delete(key, hash)
+	} else if slide {
+		_ = s.storeExpired(key, hash, wrappedEntry, timeStamp)
+	}
+	if readFlagsFromEntry(wrappedEntry)&flagMissing != 0 {
+		return nil, s.missing(key, timeStamp)
+	}
+	s.statsHitRedis()
+	if s.stale(timeStamp) {
+		ttl, flags := refreshed(wrappedEntry)
+		s.revalidate(key, ttl, flags)
+	}
+	return readEntry(wrappedEntry), nil
+}
+
+// getStoredEntry read the entry of the key from the secondary store without promoting it,
+// errKeyNotFound is returned if the entry is invalid or of another key.
+func (s *shard) getStoredEntry(key string, hash uint64) ([]byte, error) {
+	wrappedEntry, err := s.store.Get(key, hash)
+	if err == nil {
+		wrappedEntry = upgradeEntry(key, wrappedEntry)
+	}
+	if err != nil || !validEntry(wrappedEntry) ||
+		readHashFromEntry(wrappedEntry) != hash || readCRC32FromEntry(wrappedEntry) != crc32.ChecksumIEEE([]byte(key)) {
+		return nil, errKeyNotFound
+	}
+	return wrappedEntry, nil
+}
+
+// missing counts the read of negative entry and returns ErrKeyMissing.
+// The value found by the refresh is saved with LoadTTL rather than the ttl of negative entry.
+func (s *shard) missing(key string, timeStamp int64) error {
+	s.statsMissingHit()
+	if s.stale(timeStamp) {
+		s.revalidate(key, 0, 0)
+	}
+	return ErrKeyMissing
+}
+
+// expiry returns the timestamp when the entry is removed, which is StaleWhileRevalidate after the expiration.
+func (s *shard) expiry(timeStamp int64) int64 {
+	if timeStamp == 0 {
+		return 0
+	}
+	return timeStamp + int64(s.staleWindow/time.Millisecond)
+}
+
+// expired reports whether the entry is out of date and can't be served even though it is stale.
+func (s *shard) expired(timeStamp int64) bool {
+	return timeStamp != 0 && s.clock.epoch() > s.expiry(timeStamp)
+}
+
+// stale reports whether the entry is out of date but still served until it is expired.
+func (s *shard) stale(timeStamp int64) bool {
+	return timeStamp != 0 && s.clock.epoch() > timeStamp
+}
+
+// revalidate refreshes the stale key in background, the value is saved with the ttl and flags.
+func (s *shard) revalidate(key string, ttl time.Duration, flags byte) {
+	s.statsStaleHit()
+	if s.refresh != nil {
+		s.refresh(key, ttl, flags)
+	}
+}
+
+// refreshed returns the ttl and flags the stale entry is refreshed with, which are same as it is set.
+// The ttl is 0 if it is not kept by the entry.
+func refreshed(wrappedEntry []byte) (time.Duration, byte) {
+	return time.Duration(readPeriodFromEntry(wrappedEntry)) * time.Millisecond, readFlagsFromEntry(wrappedEntry) & flagSliding
+}
+
+// sync is a synchronization to keep the data read from secondary store to in-memory.
+// it reports whether the entry is promoted to in-memory, which is refused if the shard is invalidated
+// since the generation the read started.
+func (s *shard) sync(hash uint64, value []byte, generation uint64) bool {
 	s.lock.Lock()
-	if previousIndex := s.marker[hash]; previousIndex != 0 {
-		s.lock.Unlock()
-		return
+	if previousIndex := s.marker[hash]; previousIndex != 0 || s.full() || atomic.LoadUint64(&s.invalidations) != generation {
+		s.unlock()
+		return false
 	}
-	for {
-		if index, err := s.entries.Push(value); err == nil {
-			s.marker[hash] = index
-			s.redisCache.delKey(hash)
-			s.lock.Unlock()
-			s.statsSync()
-			return
-		}
-		if !s.onRemove || s.removeOldest() != nil {
-			s.lock.Unlock()
-			return
-		}
+	if err := s.push(hash, value); err != nil {
+		s.unlock()
+		return false
 	}
+	s.schedule(hash, readTimestampFromEntry(value))
+	s.evictOverLimit(hash)
+	s.unlock()
+	s.statsSync()
+	return true
 }
 
-func (s *shard) set(key string, hash uint64, value []byte, ttl time.Duration) error {
+// set saves the entry with the flags, the value of negative entry marked by flagMissing is empty.
+// The entry marked by flagSliding is extended to ttl from now as it is read. The ttl is kept by the entry if it expires.
+func (s *shard) set(key string, hash uint64, value []byte, ttl time.Duration, flags byte) error {
+	if len(key) > maxKeySize {
+		return errMaxKey
+	}
+	if s.sketch != nil {
+		s.sketch.increment(hash)
+	}
+
 	s.lock.Lock()
 
-	if previousIndex := s.marker[hash]; previousIndex != 0 {
-		if previousEntry, err := s.entries.Get(previousIndex); err == nil {
+	previousIndex := s.marker[hash]
+	if previousIndex == 0 && s.full() {
+		s.unlock()
+		return errMaxEntry
+	}
+	if previousIndex != 0 {
+		if previousEntry, err := s.getEntry(previousIndex); err == nil {
 			resetKeyFromEntry(previousEntry)
+			s.release(previousEntry)
 		}
 	}
 
-	w := wrapEntry(s.clock.exp(ttl), hash, crc32.ChecksumIEEE([]byte(key)), value, &s.buffer)
+	timeStamp := s.clock.exp(ttl)
+	// the ttl is kept as the idle period, to refresh the stale entry or to renew the entry by Touch with it.
+	period := int64(ttl / time.Millisecond)
+	w := wrapEntry(timeStamp, flags, period, hash, crc32.ChecksumIEEE([]byte(key)), key, value, &s.buffer)
+
+	if err := s.push(hash, w); err != nil {
+		delete(s.marker, hash)
+		s.unlock()
+		return err
+	}
+	s.schedule(hash, timeStamp)
+	s.evictOverLimit(hash)
+	if s.writeMode == WriteEvictOnly {
+		s.unlock()
+		s.statsModify()
+		if s.store != nil && previousIndex == 0 {
+			// the entry demoted before is older than the one set, which would be read back once it is removed.
+			// The key kept by in-memory isn't in the secondary store, since it is deleted there once it is synced.
+			_ = s.dropDemoted(key, hash)
+		}
+		return nil
+	}
+	if timeStamp != 0 {
+		// the secondary cache keeps the stale entry as long as in-memory.
+		ttl += s.staleWindow
+	}
+	// the entry is written under the lock, so the concurrent sets of the key reach the secondary cache
+	// in the same order as in-memory, and the readers of shard wait for the secondary cache meanwhile.
+	// It is copied since the buffer is reused by the next set.
+	if err := s.store.Set(key, hash, append([]byte(nil), w...), ttl); err != nil && s.writeMode == WriteThrough {
+		// the entry never reaches the secondary cache shared with the others, so it isn't kept by in-memory
+		// either, and the key is read back from the secondary cache as before. The set fails and isn't published.
+		s.discard(hash)
+		s.unlock()
+		s.statsWriteThroughFailed()
+		return err
+	}
+	// the entry dropped by the full queue of WriteBehind is counted by WriteBehindDropped.
+	s.unlock()
+	s.statsModify()
+	return nil
+}
+
+// discard removes the entry of the hash from in-memory without notifying, since it is never set.
+// It must be called with the lock held.
+func (s *shard) discard(hash uint64) {
+	itemIndex := s.marker[hash]
+	if itemIndex == 0 {
+		return
+	}
+	if wrappedEntry, err := s.getEntry(itemIndex); err == nil {
+		resetKeyFromEntry(wrappedEntry)
+		s.release(wrappedEntry)
+	}
+	delete(s.marker, hash)
+}
+
+// push saves the entry of the hash to in-memory, the oldest entries are removed if it is full and OnRemove
+// is true. If the admission is on, the entry is pushed to the window, and the oldest entries of the window
+// are admitted or rejected to make room. It must be called with the lock held.
+func (s *shard) push(hash uint64, w []byte) error {
+	s.account(len(w) + headerEntrySize)
+	if s.sketch == nil {
+		index, err := s.pushEntry(w)
+		if err != nil {
+			s.release(w)
+			return err
+		}
+		s.marker[hash] = index
+		return nil
+	}
 
 	for {
-		if index, err := s.entries.Push(w); err == nil {
-			s.marker[hash] = index
-			s.lock.Unlock()
-			s.statsModify()
+		if index, err := s.window.Push(w); err == nil {
+			s.marker[hash] = -index
+			return nil
+		}
+		if s.window.Len() == 0 {
+			// the entry is bigger than the window.
+			s.admit(hash, w)
 			return nil
 		}
+		s.admitOldest()
+	}
+}
+
+// full reports whether the shard can't keep more entries since it achieves MaxEntries and OnRemove is false.
+// It must be called with the lock held.
+func (s *shard) full() bool {
+	return !s.onRemove && s.maxEntries > 0 && len(s.marker) >= s.maxEntries
+}
+
+// evictOverLimit removes the oldest entries except the one of the hash if the shard exceeds MaxEntries
+// or MemoryBudget. It must be called with the lock held.
+func (s *shard) evictOverLimit(hash uint64) {
+	if s.maxEntries > 0 && s.onRemove {
+		s.evictOverCount(hash)
+	}
+	if s.budget != nil {
+		s.evictOverBudget(hash)
+	}
+}
+
+// pushEntry pushes the entry to the queue, the oldest entries are removed if it is full and OnRemove is true.
+// It must be called with the lock held.
+func (s *shard) pushEntry(w []byte) (int, error) {
+	for {
+		if index, err := s.entries.Push(w); err == nil {
+			return index, nil
+		}
 		if !s.onRemove || s.removeOldest() != nil {
-			s.lock.Unlock()
-			return errMaxEntry
+			return 0, errMaxEntry
 		}
 	}
 }
 
-// del the key from hashmap , entries and redis if the key exist in redis,
-func (s *shard) del(hash uint64) error {
+// del the key from hashmap , entries and secondary store if the key exist in secondary store.
+// the key is always deleted from the secondary store unless the WriteMode is WriteEvictOnly,
+// which only deletes the entry demoted before.
+// The entry is only deleted for Expired if it is still outdated.
+func (s *shard) del(key string, hash uint64, reason RemoveReason) error {
 	s.statsModify()
 
 	// pre-check the key
 	s.lock.RLock()
 	itemIndex := s.marker[hash]
-	if itemIndex == 0 {
-		if s.redisEnable {
-			if !s.redisCache.exist(hash) {
-				s.lock.RUnlock()
-				return errKeyNotFound
-			}
-		} else {
-			s.lock.RUnlock()
-			return errKeyNotFound
+	s.lock.RUnlock()
+
+	err := errKeyNotFound
+	if itemIndex != 0 {
+		s.lock.Lock()
+		err = s.delEntry(hash, reason)
+		if err == nil && s.store != nil && s.writeMode != WriteEvictOnly {
+			// the key is deleted from the secondary cache under the lock as set, so it isn't overtaken by a set,
+			// and the readers of shard wait for the secondary cache meanwhile.
+			err = s.store.Delete(key, hash)
+			s.unlock()
+			return err
 		}
-	} else if err := s.entries.CheckGet(itemIndex); err != nil {
-		s.lock.RUnlock()
+		s.unlock()
+	}
+
+	if s.store == nil || err != nil && reason == Expired {
 		return err
 	}
-	s.lock.RUnlock()
+	if err == nil {
+		return s.dropDemoted(key, hash)
+	}
+	if ok, _ := s.store.Exists(key, hash); !ok {
+		return err
+	}
+	return s.store.Delete(key, hash)
+}
 
-	s.lock.Lock()
-	itemIndex = s.marker[hash]
+// dropDemoted deletes the entry of the key demoted before by WriteEvictOnly, which is out of date once the key
+// is set, deleted or expired in in-memory. It is called outside the lock, so the readers of shard don't wait for
+// the secondary store, and the deletion is queued if the demotion is asynchronous.
+func (s *shard) dropDemoted(key string, hash uint64) error {
+	if async, ok := s.store.(*asyncStore); ok {
+		return async.deleteLater(key, hash)
+	}
+	return s.store.Delete(key, hash)
+}
 
+// delEntry removes the entry of the hash from in-memory for the reason. It must be called with the lock held.
+func (s *shard) delEntry(hash uint64, reason RemoveReason) error {
+	itemIndex := s.marker[hash]
 	if itemIndex == 0 {
-		if s.redisEnable {
-			if s.redisCache.exist(hash) {
-				s.redisCache.delKey(hash)
-				s.lock.Unlock()
-				return nil
-			}
-		}
-		s.lock.Unlock()
 		return errKeyNotFound
 	}
 
-	wrappedEntry, err := s.entries.Get(itemIndex)
+	wrappedEntry, err := s.getEntry(itemIndex)
 	if err != nil {
-		s.lock.Unlock()
 		return err
 	}
+	if reason == Expired && !s.expired(readTimestampFromEntry(wrappedEntry)) {
+		// the key has been set again.
+		return errKeyNotFound
+	}
 
 	delete(s.marker, hash)
 	resetKeyFromEntry(wrappedEntry)
-	s.lock.Unlock()
+	s.release(wrappedEntry)
+	s.notify(wrappedEntry, reason)
 	return nil
 }
 
-// remove outdated entry periodically
-func (s *shard) removeOutdated() {
-	r := s.shuffler.shuffle(len(s.marker))
+// release accounts the entry removed from in-memory, whose bytes are dead until they are popped.
+// It must be called with the lock held.
+func (s *shard) release(entry []byte) {
+	s.account(-len(entry) - headerEntrySize)
+}
+
+// invalidate removes the entry of the hash from in-memory only, the secondary store is untouched.
+func (s *shard) invalidate(hash uint64) {
 	s.lock.Lock()
-	for k, v := range s.marker {
-		if r == 0 {
-			break
-		}
+	atomic.AddUint64(&s.invalidations, 1)
+	_ = s.delEntry(hash, Deleted)
+	s.unlock()
+}
 
-		if v == 0 {
-			continue
-		}
-		wrappedEntry, err := s.entries.Get(v)
-		if err != nil {
-			continue
-		}
-		timeStamp := readTimestampFromEntry(wrappedEntry)
-		if timeStamp != 0 && s.clock.epoch() > timeStamp {
-			delete(s.marker, k)
-			resetKeyFromEntry(wrappedEntry)
-		}
-		r--
+// removeOldest remove the oldest entry by EvictionPolicy.
+func (s *shard) removeOldest() error {
+	if s.evictionPolicy == EvictClock {
+		return s.removeSecondChance()
 	}
-	s.lock.Unlock()
+	return s.removeOldestEntry()
 }
 
-// removeOldest remove the oldest entry by popping the first entry
-func (s *shard) removeOldest() error {
+// removeOldestEntry remove the oldest entry by popping the first entry
+func (s *shard) removeOldestEntry() error {
 	oldest, err := s.entries.Pop()
-	if err == nil {
-		hash := readHashFromEntry(oldest)
-		delete(s.marker, hash)
-		if s.redisEnable {
-			s.redisCache.setKey(hash, oldest, readTimestampFromEntry(oldest))
-		}
+	if err != nil {
+		return err
+	}
+	// the hash of deleted or overwritten entry has been reset, nothing to do.
+	hash := readHashFromEntry(oldest)
+	if hash == 0 {
 		return nil
 	}
-	return err
+	s.evict(hash, oldest)
+	return nil
+}
+
+// evict removes the live entry of the hash from in-memory for space, the entry is demoted to the secondary
+// store if it is alive. It must be called with the lock held.
+func (s *shard) evict(hash uint64, entry []byte) {
+	delete(s.marker, hash)
+	s.release(entry)
+	reason := Expired
+	if !s.expired(readTimestampFromEntry(entry)) {
+		reason = s.demote(hash, entry)
+	}
+	s.notify(entry, reason)
+}
+
+// demote writes the entry removed from in-memory to the secondary store if it is alive, and returns
+// the reason of removal: Demoted if it is written, Dropped if the queue of asynchronous demotion is full
+// or the secondary store fails, or NoSpace if it is not kept. The failure of secondary store is counted by
+// DemotionFailed, while the entry dropped by the queue is counted by DemotionDropped already.
+// The entry is copied since it is a part of the queue, which is reused.
+func (s *shard) demote(hash uint64, entry []byte) RemoveReason {
+	if s.store != nil && s.writeMode == WriteEvictOnly {
+		if expiration, alive := s.clock.ttl(s.expiry(readTimestampFromEntry(entry))); alive {
+			err := s.store.Set(readKeyFromEntry(entry), hash, append([]byte(nil), entry...), expiration)
+			if err == nil {
+				return Demoted
+			}
+			if err != errQueueFull {
+				s.statsDemotionFailed()
+			}
+			return Dropped
+		}
+	}
+	return NoSpace
 }
 
 func (s *shard) reset() {
 	s.lock.Lock()
-	defer s.lock.Unlock()
+	defer s.unlock()
 
+	if s.onEvict != nil {
+		for _, index := range s.marker {
+			if wrappedEntry, err := s.getEntry(index); err == nil {
+				s.notify(wrappedEntry, Reset)
+			}
+		}
+	}
 	s.marker = make(map[uint64]int)
 	s.buffer = make([]byte, s.InitEntrySize)
 
 	s.stats = NewStats()
-	s.entries.Reset()
-
-	if s.redisEnable {
-		s.redisCache.reset()
-	}
-}
-
-func (s *shard) close() {
-	if s.redisEnable {
-		s.redisCache.close()
+	// the queues are allocated again to release the memory.
+	s.entries = NewByteQueue(s.InitEntrySize, s.entries.maxCapacity)
+	s.account(-s.live)
+	s.underusedSince = time.Time{}
+	s.expiries = nil
+	if s.sketch != nil {
+		s.window = NewByteQueue(0, s.window.maxCapacity)
+		s.sketch.reset()
 	}
 }
 
@@ -290,7 +630,23 @@ func (s *shard) cap() int {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	return s.entries.Capacity()
+	return s.entries.Capacity() + s.window.Capacity()
+}
+
+func (s *shard) liveBytes() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.live
+}
+
+// overhead returns the bytes allocated which are not taken by the keys and values of the live entries.
+func (s *shard) overhead() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	headers := len(s.marker) * (headersSizeInBytes + headerEntrySize)
+	return s.entries.Capacity() + s.window.Capacity() - s.live + headers
 }
 
 func (s *shard) statsHit() {
@@ -317,10 +673,62 @@ func (s *shard) statsModify() {
 	atomic.AddInt64(&s.stats.Modify, 1)
 }
 
+func (s *shard) statsDemotionFailed() {
+	atomic.AddInt64(&s.stats.DemotionFailed, 1)
+}
+
+func (s *shard) statsWriteThroughFailed() {
+	atomic.AddInt64(&s.stats.WriteThroughFailed, 1)
+}
+
 func (s *shard) statsSync() {
 	atomic.AddInt64(&s.stats.Sync, 1)
 }
 
+func (s *shard) statsExpiredSweep() {
+	atomic.AddInt64(&s.stats.ExpiredSweep, 1)
+}
+
+func (s *shard) statsExpiredRead() {
+	atomic.AddInt64(&s.stats.ExpiredRead, 1)
+}
+
+func (s *shard) statsSlide() {
+	atomic.AddInt64(&s.stats.Slides, 1)
+}
+
+func (s *shard) statsCountEviction() {
+	atomic.AddInt64(&s.stats.CountEvictions, 1)
+}
+
+func (s *shard) statsReleased(n int) {
+	atomic.AddInt64(&s.stats.ReleasedBytes, int64(n))
+}
+
+func (s *shard) statsReclaimed(n int) {
+	atomic.AddInt64(&s.stats.ReclaimedBytes, int64(n))
+}
+
+func (s *shard) statsRequeue() {
+	atomic.AddInt64(&s.stats.Requeues, 1)
+}
+
+func (s *shard) statsRejection() {
+	atomic.AddInt64(&s.stats.Rejections, 1)
+}
+
+func (s *shard) statsPromotion() {
+	atomic.AddInt64(&s.stats.Promotions, 1)
+}
+
+func (s *shard) statsMissingHit() {
+	atomic.AddInt64(&s.stats.MissingHits, 1)
+}
+
+func (s *shard) statsStaleHit() {
+	atomic.AddInt64(&s.stats.StaleHits, 1)
+}
+
 func (s *shard) getStats() Stats {
 	return Stats{
 		Hits:        atomic.LoadInt64(&s.stats.Hits),
@@ -330,5 +738,20 @@ func (s *shard) getStats() Stats {
 		Modify:      atomic.LoadInt64(&s.stats.Modify),
 		Collision:   atomic.LoadInt64(&s.stats.Collision),
 		Sync:        atomic.LoadInt64(&s.stats.Sync),
+		StaleHits:   atomic.LoadInt64(&s.stats.StaleHits),
+		MissingHits: atomic.LoadInt64(&s.stats.MissingHits),
+		Promotions:  atomic.LoadInt64(&s.stats.Promotions),
+		Rejections:  atomic.LoadInt64(&s.stats.Rejections),
+		Requeues:    atomic.LoadInt64(&s.stats.Requeues),
+
+		ReclaimedBytes: atomic.LoadInt64(&s.stats.ReclaimedBytes),
+		ReleasedBytes:  atomic.LoadInt64(&s.stats.ReleasedBytes),
+		CountEvictions: atomic.LoadInt64(&s.stats.CountEvictions),
+		ExpiredSweep:   atomic.LoadInt64(&s.stats.ExpiredSweep),
+		ExpiredRead:    atomic.LoadInt64(&s.stats.ExpiredRead),
+		Slides:         atomic.LoadInt64(&s.stats.Slides),
+
+		DemotionFailed:     atomic.LoadInt64(&s.stats.DemotionFailed),
+		WriteThroughFailed: atomic.LoadInt64(&s.stats.WriteThroughFailed),
 	}
 }
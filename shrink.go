@@ -0,0 +1,100 @@
+package tiptop
+
+import "time"
+
+const (
+	DefaultShrinkPeriod = 10 * time.Minute
+
+	// the shard is underused when its live entries take less than the ratio of its capacity.
+	shrinkRatio = 0.25
+)
+
+// shrinkIdle shrinks the shard once it stays underused for the period, or forgets the time it becomes
+// underused if it is not underused any more. The shard is checked under the read lock first, so the shard
+// whose state doesn't change doesn't block its readers.
+func (s *shard) shrinkIdle(now time.Time, period time.Duration) {
+	s.lock.RLock()
+	underused, since := s.underused(), s.underusedSince
+	s.lock.RUnlock()
+	// nothing changes if the shard is still used, or it is underused but not for the period yet.
+	if !underused && since.IsZero() || underused && !since.IsZero() && now.Sub(since) < period {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.unlock()
+
+	if !s.underused() {
+		s.underusedSince = time.Time{}
+		return
+	}
+	if s.underusedSince.IsZero() {
+		s.underusedSince = now
+		return
+	}
+	if now.Sub(s.underusedSince) >= period {
+		s.shrink()
+	}
+}
+
+// underused reports whether the live entries take less than shrinkRatio of the capacity which is
+// bigger than the initial one. It must be called with the lock held.
+func (s *shard) underused() bool {
+	capacity := s.entries.Capacity() + s.window.Capacity()
+	return capacity > s.InitEntrySize && float64(s.live) < float64(capacity)*shrinkRatio
+}
+
+// shrink rebuilds the queues with the capacity of twice the live entries but not less than the initial one,
+// the dead entries are dropped and the indexes of the live ones are fixed up in the marker.
+// It must be called with the lock held.
+func (s *shard) shrink() {
+	s.underusedSince = time.Time{}
+	capacity := s.entries.Capacity() + s.window.Capacity()
+
+	s.entries = s.rebuild(&s.entries, s.InitEntrySize, 1)
+	if s.sketch != nil {
+		s.window = s.rebuild(&s.window, 0, -1)
+	}
+	s.statsReleased(capacity - s.entries.Capacity() - s.window.Capacity())
+}
+
+// rebuild returns the new queue keeping the live entries of q in order, the sign is 1 for entries
+// and -1 for window, as the indexes of them in the marker. It must be called with the lock held.
+func (s *shard) rebuild(q *ByteQueue, initialCapacity int, sign int) ByteQueue {
+	live := 0
+	for _, index := range s.marker {
+		if index*sign > 0 {
+			entry, _ := s.getEntry(index)
+			live += len(entry) + headerEntrySize
+		}
+	}
+	capacity := 2 * live
+	if capacity < initialCapacity {
+		capacity = initialCapacity
+	}
+	if q.maxCapacity > 0 && capacity > q.maxCapacity {
+		capacity = q.maxCapacity
+	}
+	if capacity >= q.Capacity() {
+		return *q
+	}
+
+	queue := NewByteQueue(capacity, q.maxCapacity)
+	for {
+		entry, err := q.Pop()
+		if err != nil {
+			break
+		}
+		hash := readHashFromEntry(entry)
+		if hash == 0 {
+			continue
+		}
+		index, err := queue.Push(entry)
+		if err != nil {
+			s.evict(hash, entry)
+			continue
+		}
+		s.marker[hash] = index * sign
+	}
+	return queue
+}
@@ -0,0 +1,97 @@
+package tiptop
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTipTop_Shrink(t *testing.T) {
+	for _, admission := range []bool{false, true} {
+		tip, err := NewTipTop(Config{
+			ShardSize:     1,
+			InitEntrySize: KB,
+			MaxCacheSize:  MB,
+			OnRemove:      true,
+			Admission:     admission,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		value := bytes.Repeat([]byte("a"), 100)
+		for i := 0; i < 5000; i++ {
+			_ = tip.Set(fmt.Sprintf("key-%d", i), value)
+		}
+		for i := 0; i < 5000; i++ {
+			if i%100 != 0 {
+				_ = tip.Delete(fmt.Sprintf("key-%d", i))
+			}
+		}
+		capacity := tip.Cap()
+
+		tip.Shrink()
+		if tip.Cap() >= capacity/4 || tip.GetStats().ReleasedBytes != int64(capacity-tip.Cap()) {
+			t.Fatalf("expected the capacity %d is released, got %d", capacity, tip.Cap())
+		}
+		for i := 0; i < 5000; i += 100 {
+			if got, err := tip.Get(fmt.Sprintf("key-%d", i)); err != nil || !bytes.Equal(got, value) {
+				t.Fatalf("unexpected %q, %v of key-%d", got, err, i)
+			}
+		}
+		if s := tip.shards[0]; s.live != liveBytes(s) || s.dead() != 0 {
+			t.Fatalf("unexpected live %d, dead %d", s.live, s.dead())
+		}
+
+		// the shard grows again
+		for i := 0; i < 1000; i++ {
+			_ = tip.Set(fmt.Sprintf("new-%d", i), value)
+		}
+		if got, err := tip.Get("new-999"); err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("unexpected %q, %v", got, err)
+		}
+
+		tip.Reset()
+		if tip.Cap() != KB {
+			t.Fatalf("expected the capacity is released by reset, got %d", tip.Cap())
+		}
+		_ = tip.Close()
+	}
+}
+
+func TestShard_ShrinkIdle(t *testing.T) {
+	tip, err := NewTipTop(Config{ShardSize: 1, InitEntrySize: KB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	value := bytes.Repeat([]byte("a"), 100)
+	for i := 0; i < 1000; i++ {
+		_ = tip.Set(fmt.Sprintf("key-%d", i), value)
+	}
+	s := tip.shards[0]
+	now := time.Now()
+
+	// the shard is used
+	s.shrinkIdle(now, time.Minute)
+	if !s.underusedSince.IsZero() {
+		t.Fatal("expected the shard is not underused")
+	}
+
+	for i := 1; i < 1000; i++ {
+		_ = tip.Delete(fmt.Sprintf("key-%d", i))
+	}
+	capacity := tip.Cap()
+	s.shrinkIdle(now, time.Minute)
+	s.shrinkIdle(now.Add(time.Second), time.Minute)
+	if tip.Cap() != capacity {
+		t.Fatal("expected the shard is not shrunk before the period")
+	}
+	s.shrinkIdle(now.Add(time.Minute), time.Minute)
+	if tip.Cap() != KB {
+		t.Fatalf("expected the shard is shrunk, got %d", tip.Cap())
+	}
+	if got, err := tip.Get("key-0"); err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+}
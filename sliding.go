@@ -0,0 +1,45 @@
+package tiptop
+
+import "time"
+
+// the sliding entry is extended by the read once more than 1/slideRatio of its idle period passes
+// since it is extended last time, so most reads don't take the write lock.
+const slideRatio = 8
+
+// idlePeriod returns the idle period of the sliding entry.
+func idlePeriod(wrappedEntry []byte) time.Duration {
+	return time.Duration(readIdleFromEntry(wrappedEntry)) * time.Millisecond
+}
+
+// shouldSlide reports whether the expiration of the sliding entry should be extended by the read.
+// The stale entry is not extended, which is out of date already.
+func (s *shard) shouldSlide(wrappedEntry []byte, timeStamp int64) bool {
+	idle := readIdleFromEntry(wrappedEntry)
+	if idle == 0 {
+		return false
+	}
+	now := s.clock.epoch()
+	return timeStamp > now && now+idle-timeStamp > idle/slideRatio
+}
+
+// slide extends the expiration of the sliding entry of the hash to its idle period from now, unless it has been
+// changed since it is read at index. The entry kept by the secondary store as well is extended there.
+func (s *shard) slide(key string, hash uint64, index int) {
+	s.lock.Lock()
+	if s.marker[hash] != index {
+		s.unlock()
+		return
+	}
+	wrappedEntry, err := s.getEntry(index)
+	if err != nil || readTimestampFromEntry(wrappedEntry) == 0 {
+		// the entry is persisted since it is read.
+		s.unlock()
+		return
+	}
+	w, timeStamp := s.rewrite(hash, wrappedEntry, idlePeriod(wrappedEntry))
+	s.unlock()
+	s.statsSlide()
+	if w != nil {
+		_ = s.storeExpired(key, hash, w, timeStamp)
+	}
+}
@@ -0,0 +1,126 @@
+package tiptop
+
+import (
+	"bytes"
+	"fmt"
+	"guriytan.cn/tiptop/clocktest"
+	"testing"
+	"time"
+)
+
+func TestTipTop_SetWithIdle(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{ShardSize: 1, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	_ = tip.SetWithIdle("key", []byte("v"), 8*time.Second)
+	// the read soon after the extension doesn't extend it again
+	clock.Advance(time.Second)
+	if got, err := tip.Get("key"); err != nil || string(got) != "v" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if ttl, _ := tip.TTL("key"); ttl != 7*time.Second || tip.GetStats().Slides != 0 {
+		t.Fatalf("unexpected ttl %v, stats %+v", ttl, tip.GetStats())
+	}
+
+	// the entry is kept as long as it is read
+	for i := 0; i < 5; i++ {
+		clock.Advance(5 * time.Second)
+		tip.removeOutdated()
+		if _, err := tip.Get("key"); err != nil {
+			t.Fatal(err)
+		}
+		if ttl, _ := tip.TTL("key"); ttl != 8*time.Second {
+			t.Fatalf("expected the ttl is extended, got %v", ttl)
+		}
+	}
+	if stats := tip.GetStats(); stats.Slides != 5 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// the idle entry is swept
+	clock.Advance(9 * time.Second)
+	tip.removeOutdated()
+	if tip.Len() != 0 {
+		t.Fatal("expected the idle entry is removed")
+	}
+
+	// touch extends the sliding entry by its idle period, and persist stops it
+	_ = tip.SetWithIdle("key", []byte("v"), 8*time.Second)
+	clock.Advance(4 * time.Second)
+	if err := tip.Touch("key"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := tip.TTL("key"); ttl != 8*time.Second {
+		t.Fatalf("unexpected ttl %v", ttl)
+	}
+	_ = tip.Persist("key")
+	clock.Advance(time.Minute)
+	if _, err := tip.Get("key"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := tip.TTL("key"); ttl != 0 {
+		t.Fatalf("expected the persisted entry doesn't slide, got %v", ttl)
+	}
+}
+
+func TestTipTop_SlidingExpiration(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{ShardSize: 1, DefaultTTL: 8 * time.Second, SlidingExpiration: true, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	_ = tip.Set("key", []byte("v"))
+	clock.Advance(6 * time.Second)
+	if _, err := tip.Get("key"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(6 * time.Second)
+	if got, err := tip.Get("key"); err != nil || string(got) != "v" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+}
+
+func TestTipTop_SlidingInStore(t *testing.T) {
+	store := newMemoryStore()
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{
+		ShardSize:      1,
+		MaxCacheSize:   KB,
+		SecondaryStore: store,
+		OnRemove:       true,
+		Clock:          clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	_ = tip.SetWithIdle("key-0", value, time.Minute)
+	clock.Advance(20 * time.Second)
+	for i := 1; i < 20; i++ {
+		_ = tip.Set(fmt.Sprintf("key-%d", i), value)
+	}
+	// the demoted entry expires in the store once the rest of idle period passes
+	if store.expires["key-0"] != 40*time.Second {
+		t.Fatalf("unexpected expiration in store %v", store.expires["key-0"])
+	}
+
+	// the entry read back from the store is extended
+	clock.Advance(30 * time.Second)
+	if got, err := tip.Get("key-0"); err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+	if ttl, err := tip.TTL("key-0"); err != nil || ttl != time.Minute {
+		t.Fatalf("unexpected ttl %v, %v", ttl, err)
+	}
+	if stats := tip.GetStats(); stats.Slides != 1 || stats.HitsRedis != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -2,20 +2,75 @@ package tiptop
 
 // Stats is used to analyze the cache heat rate.
 type Stats struct {
-	// Hits is a number of successfully found keys
+	// Hits is a number of successfully found keys in in-memory
 	Hits int64 `json:"hits"`
-	// HitsRedis is a number of successfully found keys in redis
+	// HitsRedis is a number of successfully found keys in redis or the other secondary cache
 	HitsRedis int64 `json:"hits-redis"`
-	// Misses is a number of not found keys
+	// Misses is a number of not found keys in in-memory,
+	// the key will be looked up in redis afterwards if redis is on.
 	Misses int64 `json:"misses"`
-	// MissesRedis is a number of not found keys in redis
+	// MissesRedis is a number of not found keys in redis or the other secondary cache
 	MissesRedis int64 `json:"misses-redis"`
+	// MissingHits is a number of found negative entries saved by SetMissing, which are not counted in Hits
+	MissingHits int64 `json:"missing-hits"`
 	// Collision is a number of happened key-collision
 	Collision int64 `json:"collision"`
 	// Modify is a number of happened key-modify
 	Modify int64 `json:"stats-modify"`
-	// Sync is a number of happened key sync from redis to in-memory
+	// Sync is a number of happened key sync from secondary cache to in-memory
 	Sync int64 `json:"stats-sync"`
+	// Promotions is a number of entries reinserted at the end of the queue since they are read by EvictLRU
+	Promotions int64 `json:"promotions"`
+	// Requeues is a number of entries visited which are requeued instead of being removed by EvictClock
+	Requeues int64 `json:"requeues"`
+	// Rejections is a number of new entries rejected by the admission since they are accessed less often than
+	// the oldest entry, which are removed from in-memory at once
+	Rejections int64 `json:"rejections"`
+	// ExpiredSweep is a number of outdated entries removed by the background sweep every SweepWindow or CleanWindow
+	ExpiredSweep int64 `json:"expired-sweep"`
+	// ExpiredRead is a number of outdated entries found by Get in in-memory before they are swept
+	ExpiredRead int64 `json:"expired-read"`
+	// Slides is a number of sliding entries whose expiration is extended by Get
+	Slides int64 `json:"slides"`
+	// CountEvictions is a number of entries removed since the shard keeps more entries than MaxEntries
+	CountEvictions int64 `json:"count-evictions"`
+	// ReclaimedBytes is the bytes of dead entries dropped by the compaction
+	ReclaimedBytes int64 `json:"reclaimed-bytes"`
+	// ReleasedBytes is the bytes of capacity released by shrink
+	ReleasedBytes int64 `json:"released-bytes"`
+	// DemotionQueued is a number of entries queued by the asynchronous demotion
+	DemotionQueued int64 `json:"demotion-queued"`
+	// DemotionDropped is a number of demoted entries dropped since the queue is full
+	DemotionDropped int64 `json:"demotion-dropped"`
+	// DemotionFlushed is a number of demoted entries written to secondary cache
+	DemotionFlushed int64 `json:"demotion-flushed"`
+	// DemotionFailed is a number of demoted entries failed to write to secondary cache, which are removed as Dropped
+	DemotionFailed int64 `json:"demotion-failed"`
+	// WriteThroughFailed is a number of entries of WriteThrough failed to write to secondary cache,
+	// whose Set returns the error and which aren't kept by in-memory
+	WriteThroughFailed int64 `json:"write-through-failed"`
+	// WriteBehindQueued is a number of entries queued by WriteBehind
+	WriteBehindQueued int64 `json:"write-behind-queued"`
+	// WriteBehindDropped is a number of entries of WriteBehind dropped since the queue is full
+	WriteBehindDropped int64 `json:"write-behind-dropped"`
+	// WriteBehindFlushed is a number of entries of WriteBehind written to secondary cache
+	WriteBehindFlushed int64 `json:"write-behind-flushed"`
+	// WriteBehindFailed is a number of entries of WriteBehind failed to write to secondary cache
+	WriteBehindFailed int64 `json:"write-behind-failed"`
+	// Invalidations is a number of keys invalidated by the other TipTop through InvalidationChannel
+	Invalidations int64 `json:"invalidations"`
+	// Loads is a number of calls of Loader by GetOrLoad, the concurrent calls of the same key are counted once
+	Loads int64 `json:"loads"`
+	// LoadErrors is a number of calls of Loader which return error
+	LoadErrors int64 `json:"load-errors"`
+	// LoadTime is the total time of calls of Loader in nanoseconds, LoadTime / Loads is the average latency
+	LoadTime int64 `json:"load-time"`
+	// StaleHits is a number of stale entries served within StaleWhileRevalidate, they are counted in Hits as well
+	StaleHits int64 `json:"stale-hits"`
+	// Refreshes is a number of background refreshes of the stale entries which succeed
+	Refreshes int64 `json:"refreshes"`
+	// RefreshErrors is a number of background refreshes of the stale entries which fail
+	RefreshErrors int64 `json:"refresh-errors"`
 }
 
 func NewStats() Stats {
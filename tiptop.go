@@ -1,6 +1,8 @@
 package tiptop
 
 import (
+	"errors"
+	"math"
 	"time"
 )
 
@@ -18,7 +20,19 @@ type TipTop struct {
 	hash      hashCalculator
 	config    *Config
 	close     chan bool
-	shuffler  shuffler
+
+	// store is the secondary cache shared by all shards, nil if it is off.
+	store SecondaryStore
+	// ownStore reports whether the store is created by tiptop and should be closed with it.
+	ownStore bool
+	// async is the asynchronous demotion wrapping the store, nil if it is off.
+	async *asyncStore
+	// invalidator broadcasts the mutated keys, nil if InvalidationChannel is not set.
+	invalidator *invalidator
+	// loads deduplicates the loads of GetOrLoad.
+	loads *loadGroup
+	// budget is the memory budget shared by all shards, nil if MemoryBudget is not set.
+	budget *memoryBudget
 }
 
 // NewTipTop return a Tip-Top instance.
@@ -34,12 +48,60 @@ func NewTipTop(config Config) (*TipTop, error) {
 		shardSize: uint64(config.ShardSize - 1),
 		hash:      defaultHashCalculator(),
 		config:    &config,
-		shuffler:  newDefaultShuffle(),
+		close:     make(chan bool),
+		loads:     newLoadGroup(),
+	}
+
+	if config.OnRemove || config.WriteMode != WriteEvictOnly {
+		if config.SecondaryStore != nil {
+			t.store = config.SecondaryStore
+		} else if config.RedisAddr != "" {
+			store, err := newRedisCache(&config)
+			if err != nil {
+				return nil, err
+			}
+			t.store = store
+			t.ownStore = true
+		} else if config.DiskPath != "" {
+			store, err := newDiskStore(config.DiskPath, config.DiskSegmentSize, config.DiskMaxSize, config.Clock)
+			if err != nil {
+				return nil, err
+			}
+			t.store = store
+			t.ownStore = true
+		}
+	}
+
+	store := t.store
+	if (config.AsyncDemotion || config.WriteMode == WriteBehind) && t.store != nil {
+		t.async = newAsyncStore(t.store, &config)
+		store = t.async
+	}
+
+	if config.MemoryBudget > 0 {
+		t.budget = newMemoryBudget(config.MemoryBudget, config.ShardSize)
 	}
 
 	// init every shard
 	for i := 0; i < config.ShardSize; i++ {
-		t.shards[i] = initShard(&config)
+		t.shards[i] = initShard(&config, store, t.budget)
+		if config.StaleWhileRevalidate > 0 {
+			t.shards[i].refresh = t.refresh
+		}
+	}
+
+	if config.InvalidationChannel != "" {
+		redisStore, ok := t.store.(*redisCache)
+		if !ok {
+			t.closeStore()
+			return nil, errors.New("invalidation channel requires redis")
+		}
+		invalidator, err := newInvalidator(redisStore.client, config.InvalidationChannel, t.invalidate)
+		if err != nil {
+			t.closeStore()
+			return nil, err
+		}
+		t.invalidator = invalidator
 	}
 
 	// coroutines run
@@ -48,29 +110,60 @@ func NewTipTop(config Config) (*TipTop, error) {
 	return t, nil
 }
 
-// tikTok run background to remove outdated entry.
+// tikTok run background to remove outdated entry and compact the dead space, every work has its own window.
 func (t *TipTop) tikTok() {
-	if t.config.CleanWindow > 0 {
-		go func() {
-			ticker := time.NewTicker(t.config.CleanWindow)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-ticker.C:
-					t.removeOutdated()
-				case <-t.close:
-					return
+	go func() {
+		sweep, stopSweep := newTicker(t.config.SweepWindow)
+		defer stopSweep()
+		clean, stopClean := newTicker(t.config.CleanWindow)
+		defer stopClean()
+		compaction, stopCompaction := newTicker(t.config.CompactionWindow)
+		defer stopCompaction()
+		for {
+			select {
+			case <-sweep:
+				t.removeOutdated()
+			case <-clean:
+				t.cleanUp()
+			case now := <-compaction:
+				t.trim()
+				t.compact()
+				if t.config.ShrinkPeriod > 0 {
+					t.shrinkIdle(now)
 				}
+			case <-t.close:
+				return
 			}
-		}()
+		}
+	}()
+}
+
+// newTicker returns the channel ticking every window and the function to stop it,
+// the channel is nil if the window is not positive, so it never ticks.
+func newTicker(window time.Duration) (<-chan time.Time, func()) {
+	if window <= 0 {
+		return nil, func() {}
 	}
+	ticker := time.NewTicker(window)
+	return ticker.C, ticker.Stop
 }
 
-// close is used to signal a shutdown of the cache when you are done with it.
+// Close is used to signal a shutdown of the cache when you are done with it.
+// The Redis client or the disk files opened by tiptop are closed as well.
 func (t *TipTop) Close() error {
 	close(t.close)
-	for _, shard := range t.shards {
-		shard.close()
+	if t.invalidator != nil {
+		_ = t.invalidator.close()
+	}
+	return t.closeStore()
+}
+
+func (t *TipTop) closeStore() error {
+	if t.async != nil {
+		_ = t.async.Close()
+	}
+	if t.ownStore {
+		return t.store.Close()
 	}
 	return nil
 }
@@ -81,38 +174,210 @@ func (t *TipTop) Get(key string) (value []byte, err error) {
 	return t.getShard(hash).get(key, hash)
 }
 
+// GetOrLoad reads entry for the key, if the key is not found or outdated, the value is loaded by the loader
+// and saved under the key with LoadTTL. The concurrent loads of the same key are deduplicated, the loader
+// is called once and its value or error is returned to all callers.
+// Config.Loader is used if the loader is nil.
+func (t *TipTop) GetOrLoad(key string, loader Loader) ([]byte, error) {
+	if loader == nil {
+		loader = t.config.Loader
+	}
+	if loader == nil {
+		return nil, errNoLoader
+	}
+
+	value, err := t.Get(key)
+	if err != errKeyNotFound && err != errEntryIsDead {
+		return value, err
+	}
+	return t.loads.do(key, loader, t.saveLoaded(key, t.config.LoadTTL, t.ttlFlags()))
+}
+
+// saveLoaded returns the function saving the value loaded with the ttl and flags,
+// or the negative entry if the key is missing.
+func (t *TipTop) saveLoaded(key string, ttl time.Duration, flags byte) func(value []byte, err error) {
+	return func(value []byte, err error) {
+		if err == ErrKeyMissing {
+			_ = t.SetMissing(key, 0)
+			return
+		}
+		_ = t.set(key, value, ttl, flags)
+	}
+}
+
+// refresh reloads the stale key by Config.Loader in background, the key being loaded is skipped.
+// The value is saved with the ttl and flags of the stale entry, or with LoadTTL if its ttl is unknown.
+func (t *TipTop) refresh(key string, ttl time.Duration, flags byte) {
+	if ttl == 0 {
+		ttl, flags = t.config.LoadTTL, t.ttlFlags()
+	}
+	t.loads.doAsync(key, t.config.Loader, t.saveLoaded(key, ttl, flags))
+}
+
 // Set saves entry under the key
 func (t *TipTop) Set(key string, value []byte) error {
 	return t.SetWithTTL(key, value, t.config.DefaultTTL)
 }
 
-// Set saves entry under the key with expiration
+// Set saves entry under the key with expiration, which is sliding if SlidingExpiration is true.
 func (t *TipTop) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	return t.set(key, value, ttl, t.ttlFlags())
+}
+
+// SetWithIdle saves entry under the key which expires once it isn't read for the idle period,
+// every read extends the expiration to idle from now. 0 means never out of date.
+func (t *TipTop) SetWithIdle(key string, value []byte, idle time.Duration) error {
+	return t.set(key, value, idle, flagSliding)
+}
+
+// ttlFlags returns the flags of the entries set by SetWithTTL.
+func (t *TipTop) ttlFlags() byte {
+	if t.config.SlidingExpiration {
+		return flagSliding
+	}
+	return 0
+}
+
+// set saves the entry of the key with the flags, and broadcasts the key.
+func (t *TipTop) set(key string, value []byte, ttl time.Duration, flags byte) error {
+	hash := t.hash.sum64(key)
+	if err := t.getShard(hash).set(key, hash, value, ttl, flags); err != nil {
+		return err
+	}
+	return t.publish(key)
+}
+
+// SetMissing saves the negative entry of the key which doesn't exist in the source of data,
+// Get returns ErrKeyMissing for the key until the entry is out of date or the key is set.
+// Config.MissingTTL is used if the ttl is 0.
+func (t *TipTop) SetMissing(key string, ttl time.Duration) error {
+	if ttl == 0 {
+		ttl = t.config.MissingTTL
+	}
+	return t.set(key, nil, ttl, flagMissing)
+}
+
+// TTL returns the remaining time to live of the key, 0 if the key never expires.
+// errEntryIsDead is returned if the key is out of date, even though it is still served by StaleWhileRevalidate.
+func (t *TipTop) TTL(key string) (time.Duration, error) {
+	hash := t.hash.sum64(key)
+	return t.getShard(hash).ttl(key, hash)
+}
+
+// Expire sets the expiration of the key to ttl from now without setting the value again,
+// 0 means never out of date. The key kept by the secondary cache is changed as well.
+func (t *TipTop) Expire(key string, ttl time.Duration) error {
+	hash := t.hash.sum64(key)
+	if err := t.getShard(hash).expire(key, hash, ttl, false); err != nil {
+		return err
+	}
+	return t.publish(key)
+}
+
+// Persist removes the expiration of the key, so it is never out of date and doesn't slide any more.
+func (t *TipTop) Persist(key string) error {
+	return t.Expire(key, 0)
+}
+
+// Touch renews the expiration of the key to its own ttl from now, as if it is set again with the same ttl.
+// The sliding key is extended by its idle period, as if it is read. The key never out of date is left unchanged,
+// errTTLUnknown is returned if its ttl isn't kept, such as the key written to the secondary cache by the former version.
+func (t *TipTop) Touch(key string) error {
 	hash := t.hash.sum64(key)
-	return t.getShard(hash).set(key, hash, value, ttl)
+	if err := t.getShard(hash).expire(key, hash, 0, true); err != nil {
+		return err
+	}
+	return t.publish(key)
 }
 
 // Delete removes the key
 func (t *TipTop) Delete(key string) error {
 	hash := t.hash.sum64(key)
-	return t.getShard(hash).del(hash)
+	err := t.getShard(hash).del(key, hash, Deleted)
+	if e := t.publish(key); err == nil {
+		err = e
+	}
+	return err
+}
+
+// publish broadcasts the mutated key to the other TipTop if InvalidationChannel is set.
+func (t *TipTop) publish(key string) error {
+	if t.invalidator == nil {
+		return nil
+	}
+	return t.invalidator.publish(key)
+}
+
+// invalidate drops the entry of the key from in-memory, which is mutated by the other TipTop.
+func (t *TipTop) invalidate(key string) {
+	hash := t.hash.sum64(key)
+	t.getShard(hash).invalidate(hash)
 }
 
-// Reset empties all cache shards
+// Reset empties all cache shards and the secondary cache
 func (t *TipTop) Reset() {
 	for _, shard := range t.shards {
 		shard.reset()
 	}
+	if t.async != nil {
+		_ = t.async.Reset()
+	} else if t.store != nil {
+		_ = t.store.Reset()
+	}
 }
 
 func (t *TipTop) getShard(hash uint64) *shard {
 	return t.shards[hash&t.shardSize]
 }
 
+// removeOutdated removes the entries due from every shard, at most CleanBudget of them per shard.
 func (t *TipTop) removeOutdated() {
-	n := t.shuffler.shuffle(int(t.shardSize))
-	for i := 0; i < n; i++ {
-		t.shards[t.shuffler.shuffle(int(t.shardSize))].removeOutdated()
+	for _, shard := range t.shards {
+		shard.removeExpired(t.config.CleanBudget)
+	}
+}
+
+// cleanUp removes all the entries due from every shard, including the ones left by removeOutdated.
+func (t *TipTop) cleanUp() {
+	for _, shard := range t.shards {
+		shard.removeExpired(math.MaxInt32)
+	}
+}
+
+// trim removes the oldest entries of the shards beyond their share while MemoryBudget is exceeded.
+func (t *TipTop) trim() {
+	if t.budget == nil {
+		return
+	}
+	for _, shard := range t.shards {
+		if !t.budget.exceeded() {
+			return
+		}
+		shard.trim()
+	}
+}
+
+// compact reclaims the dead space of every shard within CompactionBudget.
+func (t *TipTop) compact() {
+	for _, shard := range t.shards {
+		shard.compact(t.config.CompactionBudget)
+	}
+}
+
+// shrinkIdle shrinks the shards which stay underused for ShrinkPeriod.
+func (t *TipTop) shrinkIdle(now time.Time) {
+	for _, shard := range t.shards {
+		shard.shrinkIdle(now, t.config.ShrinkPeriod)
+	}
+}
+
+// Shrink releases the capacity of shards which is much more than their entries need at once,
+// the capacity is reduced to twice the live entries but not less than InitEntrySize.
+func (t *TipTop) Shrink() {
+	for _, shard := range t.shards {
+		shard.lock.Lock()
+		shard.shrink()
+		shard.unlock()
 	}
 }
 
@@ -134,6 +399,31 @@ func (t *TipTop) Cap() int {
 	return capacity
 }
 
+// LiveBytes returns amount of bytes taken by the live entries, including the keys, values and headers,
+// which is limited by MemoryBudget.
+func (t *TipTop) LiveBytes() int {
+	var live int
+	for _, shard := range t.shards {
+		live += shard.liveBytes()
+	}
+	return live
+}
+
+// AllocatedBytes returns amount of bytes allocated by the shards for entries, which is same as Cap.
+func (t *TipTop) AllocatedBytes() int {
+	return t.Cap()
+}
+
+// Overhead returns amount of bytes allocated which are not taken by the keys and values of the live entries,
+// which are the headers, the dead entries and the free space.
+func (t *TipTop) Overhead() int {
+	var overhead int
+	for _, shard := range t.shards {
+		overhead += shard.overhead()
+	}
+	return overhead
+}
+
 // Stats returns cache's statistics
 func (t *TipTop) GetStats() Stats {
 	var s Stats
@@ -145,6 +435,40 @@ func (t *TipTop) GetStats() Stats {
 		s.MissesRedis += tmp.MissesRedis
 		s.Modify += tmp.Modify
 		s.Collision += tmp.Collision
+		s.Sync += tmp.Sync
+		s.StaleHits += tmp.StaleHits
+		s.MissingHits += tmp.MissingHits
+		s.Promotions += tmp.Promotions
+		s.Rejections += tmp.Rejections
+		s.Requeues += tmp.Requeues
+		s.ReclaimedBytes += tmp.ReclaimedBytes
+		s.ReleasedBytes += tmp.ReleasedBytes
+		s.CountEvictions += tmp.CountEvictions
+		s.ExpiredSweep += tmp.ExpiredSweep
+		s.ExpiredRead += tmp.ExpiredRead
+		s.Slides += tmp.Slides
+		s.DemotionFailed += tmp.DemotionFailed
+		s.WriteThroughFailed += tmp.WriteThroughFailed
+	}
+	if t.async != nil {
+		tmp := t.async.getStats()
+		s.DemotionQueued = tmp.DemotionQueued
+		s.DemotionDropped = tmp.DemotionDropped
+		s.DemotionFlushed = tmp.DemotionFlushed
+		s.DemotionFailed += tmp.DemotionFailed
+		s.WriteBehindQueued = tmp.WriteBehindQueued
+		s.WriteBehindDropped = tmp.WriteBehindDropped
+		s.WriteBehindFlushed = tmp.WriteBehindFlushed
+		s.WriteBehindFailed = tmp.WriteBehindFailed
+	}
+	if t.invalidator != nil {
+		s.Invalidations = t.invalidator.getStats().Invalidations
 	}
+	loads := t.loads.getStats()
+	s.Loads = loads.Loads
+	s.LoadErrors = loads.LoadErrors
+	s.LoadTime = loads.LoadTime
+	s.Refreshes = loads.Refreshes
+	s.RefreshErrors = loads.RefreshErrors
 	return s
 }
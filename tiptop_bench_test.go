@@ -19,14 +19,19 @@ func BenchmarkTipTop_Get(b *testing.B) {
 	}
 	_ = pprof.StartCPUProfile(f)
 	defer pprof.StopCPUProfile()
+	server := newTestRedis(b)
 	for _, shards := range []int{512, 1024, 4096} {
 		b.Run(fmt.Sprintf("%d-shards", shards), func(b *testing.B) {
-			t, _ := NewTipTop(Config{
+			t, err := NewTipTop(Config{
 				ShardSize:    shards,
 				MaxCacheSize: KB * shards,
-				RedisAddr:    "172.18.29.81:6379",
+				RedisAddr:    server.Addr(),
 				OnRemove:     true,
 			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer t.Close()
 			message := bytes.Repeat([]byte("a"), 2)
 			for i := 0; i < b.N; i++ {
 				_ = t.Set(fmt.Sprintf("key-%d", i), message)
@@ -77,3 +82,43 @@ func BenchmarkTipTop_Set(b *testing.B) {
 		})
 	}
 }
+
+// BenchmarkTipTop_HitRatio compares the hit ratio of the eviction policies and the admission on the skewed workload,
+// in which the key read is missing in cache is set at once.
+func BenchmarkTipTop_HitRatio(b *testing.B) {
+	message := bytes.Repeat([]byte("a"), 64)
+	for _, policy := range []struct {
+		name      string
+		policy    EvictionPolicy
+		admission bool
+	}{{"fifo", EvictFIFO, false}, {"lru", EvictLRU, false}, {"clock", EvictClock, false}, {"tinylfu", EvictFIFO, true}} {
+		for _, skew := range []float64{1.01, 1.2} {
+			b.Run(fmt.Sprintf("%s-zipf-%.2f", policy.name, skew), func(b *testing.B) {
+				cache, err := NewTipTop(Config{
+					ShardSize:      16,
+					MaxCacheSize:   16 * 16 * KB,
+					OnRemove:       true,
+					EvictionPolicy: policy.policy,
+					Admission:      policy.admission,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				zipf := rand.NewZipf(rand.New(rand.NewSource(1)), skew, 1, 1<<20)
+
+				var hits int
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					key := fmt.Sprintf("key-%d", zipf.Uint64())
+					if _, err := cache.Get(key); err == nil {
+						hits++
+					} else {
+						_ = cache.Set(key, message)
+					}
+				}
+				b.ReportMetric(float64(hits)/float64(b.N), "hit-ratio")
+			})
+		}
+	}
+}
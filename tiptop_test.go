@@ -3,20 +3,24 @@ package tiptop
 import (
 	"encoding/json"
 	"fmt"
+	"guriytan.cn/tiptop/clocktest"
 	"testing"
+	"time"
 )
 
 func TestNewTipTop(t *testing.T) {
-	tip, err := NewTipTop(DefaultConfig())
+	tip, err := NewTipTop(testConfig())
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
+	defer tip.Close()
 	fmt.Println(tip)
 }
 
 func TestTipTop_Get(t *testing.T) {
-	tip, _ := NewTipTop(DefaultConfig())
+	tip, _ := NewTipTop(testConfig())
+	defer tip.Close()
 	insertData(tip)
 	out := make(map[string]string)
 	bytes, err := tip.Get("key1")
@@ -31,11 +35,12 @@ func TestTipTop_Get(t *testing.T) {
 }
 
 func TestTipTop_Delete(t *testing.T) {
-	tip, err := NewTipTop(DefaultConfig())
+	tip, err := NewTipTop(testConfig())
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
+	defer tip.Close()
 	insertData(tip)
 	out := make(map[string]string)
 	err = tip.Delete("key")
@@ -54,11 +59,12 @@ func TestTipTop_Delete(t *testing.T) {
 }
 
 func TestTipTop_Reset(t *testing.T) {
-	tip, err := NewTipTop(DefaultConfig())
+	tip, err := NewTipTop(testConfig())
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
+	defer tip.Close()
 	insertData(tip)
 	tip.Reset()
 
@@ -83,27 +89,37 @@ func TestTipTop_Reset(t *testing.T) {
 }
 
 func TestTipTop_Len(t *testing.T) {
-	tip, err := NewTipTop(DefaultConfig())
+	tip, err := NewTipTop(testConfig())
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
+	defer tip.Close()
 	insertData(tip)
 
 	fmt.Printf("容量：%v", tip.Len())
 }
 
 func TestTipTop_Cap(t *testing.T) {
-	tip, err := NewTipTop(DefaultConfig())
+	tip, err := NewTipTop(testConfig())
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
+	defer tip.Close()
 	insertData(tip)
 
 	fmt.Printf("容量：%v", tip.Cap())
 }
 
+// testConfig returns DefaultConfig with the small initial size of shard, since all shards allocate it at once
+// and again by Reset.
+func testConfig() Config {
+	config := DefaultConfig()
+	config.InitEntrySize = KB
+	return config
+}
+
 func insertData(t *TipTop) {
 	value := map[string]string{
 		"key1": "value1",
@@ -113,3 +129,53 @@ func insertData(t *TipTop) {
 	_ = t.Set("key1", bytes)
 	_ = t.Set("key2", bytes)
 }
+
+func TestTipTop_Close(t *testing.T) {
+	tip, err := NewTipTop(Config{ShardSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tip.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTipTop_SetMissing(t *testing.T) {
+	clock := clocktest.NewClock(time.Now())
+	tip, err := NewTipTop(Config{ShardSize: 1, MissingTTL: 10 * time.Second, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tip.Close()
+	_ = tip.SetMissing("key", 0)
+	if _, err := tip.Get("key"); err != ErrKeyMissing {
+		t.Fatalf("expected ErrKeyMissing, got %v", err)
+	}
+	if stats := tip.GetStats(); stats.MissingHits != 1 || stats.Hits != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// the negative entry expires by MissingTTL
+	clock.Advance(11 * time.Second)
+	if _, err := tip.Get("key"); err != errEntryIsDead {
+		t.Fatalf("expected errEntryIsDead, got %v", err)
+	}
+
+	// the negative entry is overwritten by the value
+	_ = tip.SetMissing("key", time.Minute)
+	_ = tip.Set("key", []byte("value"))
+	if got, err := tip.Get("key"); err != nil || string(got) != "value" {
+		t.Fatalf("unexpected %q, %v", got, err)
+	}
+}
+
+// waitFor waits until the condition is true.
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition is not satisfied in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}